@@ -17,6 +17,24 @@
 // if UnderEnabled { x } around the code, and make it a no-op for elimination
 // that way.
 //
+// When the tag is given, the output can still be steered at runtime.
+// UnderSetActive switches it on and off, UnderFilter restricts it to callers
+// whose file or function matches a glob, and UnderSetOutput, UnderToFile and
+// UnderToLogger send it somewhere other than stdout (UnderToLogger takes a
+// logutil logger method, so the output lands in the sinks of that logger).
+// Without the tag these are no-ops as well.
+//
+// To see how calls nest, put defer UnderEnter()() at the top of a function.
+// It prints when the flow arrives and when it leaves (with the time spent),
+// and indents everything printed in between by one more level.  Each line
+// carries the id of the goroutine that printed it, so interleaved flows can
+// be told apart.
+//
+// FormatQuery runs the query of a dumped GraphQL request through the graphql
+// parser and pretty printer.  Long string values are cut short and the values
+// of secret looking names (password, token, ...) are redacted, see
+// UnderSetMaxLiteral and UnderSetSecretNames.
+//
 // The "under" is for understanding.  This is logging for understanding.  More
 // detailed than "debug" logging, and even more detailed than (or different than)
 // "trace" logging.
@@ -0,0 +1,139 @@
+//go:build underlog
+
+package abelogutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rhedin/Abe_common/stringutil"
+)
+
+// The state which decides if and where UnderPrintf output goes.  All of it
+// is guarded by underLock, since UnderPrintf gets called from any goroutine.
+var (
+	underLock    sync.RWMutex
+	underActive  = true
+	underFilters []*regexp.Regexp
+	underOutput  io.Writer = os.Stdout
+	underFile    *os.File
+	underLogFunc func(msg ...any)
+)
+
+// UnderSetActive switches the output on or off at runtime.  The output is
+// on by default, as long as the underlog tag was given at build time.
+func UnderSetActive(active bool) {
+	underLock.Lock()
+	defer underLock.Unlock()
+	underActive = active
+}
+
+// UnderFilter restricts the output to callers whose file or function matches
+// one of the given globs, e.g. "*/graphql/*" or "*eliasdb/api.*".  Calling it
+// without globs removes the filter again.  The globs are turned into regular
+// expressions by stringutil.GlobToRegex.  If one glob is broken, the filter
+// stays as it was.
+func UnderFilter(globs ...string) error {
+	var filters []*regexp.Regexp
+
+	for _, glob := range globs {
+		re, err := stringutil.GlobToRegex(glob)
+		if err == nil {
+			var compiled *regexp.Regexp
+			if compiled, err = regexp.Compile("^" + re + "$"); err == nil {
+				filters = append(filters, compiled)
+				continue
+			}
+		}
+		return fmt.Errorf("Invalid underlog filter %v: %v", glob, err)
+	}
+
+	underLock.Lock()
+	defer underLock.Unlock()
+	underFilters = filters
+
+	return nil
+}
+
+// UnderSetOutput sends the output to the given writer instead of stdout.
+// A nil writer means stdout again.
+func UnderSetOutput(w io.Writer) {
+	if w == nil {
+		w = os.Stdout
+	}
+	underLock.Lock()
+	defer underLock.Unlock()
+	underRedirect(w, nil, nil)
+}
+
+// UnderToFile appends the output to the given file.  The file stays open
+// until the output is redirected somewhere else.
+func UnderToFile(filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	underLock.Lock()
+	defer underLock.Unlock()
+	underRedirect(file, file, nil)
+	return nil
+}
+
+// UnderToLogger hands every line to a log function, which is meant to be a
+// method of a logutil logger, e.g.
+//
+//	abelog.UnderToLogger(logutil.GetLogger("under").Debug)
+//
+// That way the output ends up in whatever sinks are registered for the scope.
+// The trailing newline of a line is removed, since the sinks add their own.
+func UnderToLogger(logFunc func(msg ...any)) {
+	underLock.Lock()
+	defer underLock.Unlock()
+	underRedirect(nil, nil, logFunc)
+}
+
+// underRedirect replaces the current output, and closes the file we opened
+// for the previous one, if there was one.  The caller must hold underLock.
+func underRedirect(w io.Writer, file *os.File, logFunc func(msg ...any)) {
+	if underFile != nil {
+		underFile.Close()
+	}
+	underOutput = w
+	underFile = file
+	underLogFunc = logFunc
+}
+
+// underWanted tells whether output from the given caller should be produced.
+func underWanted(file string, function string) bool {
+	underLock.RLock()
+	defer underLock.RUnlock()
+
+	if !underActive {
+		return false
+	}
+	if len(underFilters) == 0 {
+		return true
+	}
+	for _, filter := range underFilters {
+		if filter.MatchString(file) || filter.MatchString(function) {
+			return true
+		}
+	}
+	return false
+}
+
+// underWrite sends a finished piece of output to wherever it should go.
+func underWrite(s string) {
+	underLock.RLock()
+	defer underLock.RUnlock()
+
+	if underLogFunc != nil {
+		underLogFunc(strings.TrimSuffix(s, "\n"))
+		return
+	}
+	io.WriteString(underOutput, s)
+}
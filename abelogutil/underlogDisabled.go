@@ -2,16 +2,54 @@
 
 package abelogutil
 
+import "io"
+
 const UnderEnabled = false
 
 func UnderPrintf(format string, arguments ...any) {
 	// Do nothing.
 }
 
+// UnderEnter hands back a function which does nothing, so
+// defer abelog.UnderEnter()() costs next to nothing.
+func UnderEnter() func() {
+	return underNop
+}
+
+func underNop() {
+}
+
 func FormatQuery(requestString string) string {
 	return ""
 }
 
+// The runtime controls do nothing either.  They are here so code which sets
+// up the output (see underlogControl.go) compiles with and without the tag.
+
+func UnderSetActive(active bool) {
+}
+
+func UnderFilter(globs ...string) error {
+	return nil
+}
+
+func UnderSetOutput(w io.Writer) {
+}
+
+func UnderToFile(filename string) error {
+	return nil
+}
+
+func UnderToLogger(logFunc func(msg ...any)) {
+}
+
+func UnderSetMaxLiteral(length int) {
+}
+
+func UnderSetSecretNames(globs ...string) error {
+	return nil
+}
+
 // Here's what Grok said about this.
 // Go's dead-code elimination (which can remove the whole if false { ... } block)
 // happens after type checking. The symbol must be resolvable first.
@@ -46,21 +46,60 @@ func justpad(builder *strings.Builder, inputnum int, length int) {
 }
 
 func UnderPrintf(format string, arguments ...any) {
+	underPrintf(format, arguments...)
+}
+
+// UnderEnter prints that the flow arrived in the calling function, and
+// returns the function which prints that the flow left it again, together
+// with the time it spent in there.  It is meant to be used like this:
+//
+//	defer abelog.UnderEnter()()
+//
+// Everything printed in between, from the same goroutine, is indented by
+// one more level, so nested calls show up as a tree.
+func UnderEnter() func() {
+	start := time.Now()
+	if !underPrintf("-> enter\n") {
+		return underNop
+	}
+	gid := goroutineID()
+	underChangeDepth(gid, 1)
+	return func() {
+		underChangeDepth(gid, -1)
+		underPrintf("<- exit after %v\n", time.Since(start))
+	}
+}
+
+func underNop() {
+}
+
+// underPrintf does the work for UnderPrintf, UnderEnter and the function
+// UnderEnter returns.  All three sit at the same distance from the function
+// we want to report on, so we skip 3 frames: runtime.Callers, underPrintf
+// and the exported function (or the exit closure).  It tells whether
+// anything was printed.
+func underPrintf(format string, arguments ...any) bool {
 	pc := make([]uintptr, 5)    // Slice to hold up to 5 program counters
-	n := runtime.Callers(2, pc) // Skip 2 frames
+	n := runtime.Callers(3, pc) // Skip 3 frames
 	if n == 0 {
-		fmt.Printf("The call to runtime.Callers returned 0.\n")
-		return
+		underWrite("The call to runtime.Callers returned 0.\n")
+		return false
 	}
 	pc = pc[:n] // Trim the slice to actual number of PCs
 	frames := runtime.CallersFrames(pc)
 	whoCalledUs, _ := frames.Next()
+	if !underWanted(whoCalledUs.File, whoCalledUs.Function) {
+		return false
+	}
+	gid := goroutineID()
 	whoCalledThem, weKnowWhoCalledOurCaller := frames.Next()
 	if !weKnowWhoCalledOurCaller {
-		fmt.Printf("We do not have information about the caller of our caller.\n")
+		underWrite("We do not have information about the caller of our caller.\n")
 	}
 	var builder strings.Builder
 	builder.WriteString(time.Now().Format("15:04:05.000"))
+	builder.WriteString(" g")
+	justpad(&builder, int(gid), 4)
 	builder.WriteString(" ")
 	trunjustdots(&builder, whoCalledUs.File, 40)
 	builder.WriteString(" ")
@@ -77,11 +116,13 @@ func UnderPrintf(format string, arguments ...any) {
 		trunjustdots(&builder, whoCalledThem.Function, 40)
 		builder.WriteString(" ")
 	}
+	builder.WriteString(strings.Repeat("    ", underDepth(gid)))
 	builder.WriteString(format)
-	fmt.Printf(builder.String(), arguments...)
+	underWrite(fmt.Sprintf(builder.String(), arguments...))
+	return true
 }
 
-// We put in something like this:
+// formatQueryAdHoc puts in something like this:
 // POST /db/v1/graphql/main HTTP/1.1
 // Host: localhost:9090
 // Accept: */*
@@ -118,7 +159,11 @@ func UnderPrintf(format string, arguments ...any) {
 //			general(storeNode:$node){}
 //		}
 //	}
-func FormatQuery(requestString string) string {
+//
+// This was FormatQuery before the query went through the graphql parser.
+// FormatQuery (see underlogQuery.go) still falls back on it when the body
+// is not the JSON it expects.
+func formatQueryAdHoc(requestString string) string {
 
 	// Pick off the last line.
 
@@ -127,10 +172,10 @@ func FormatQuery(requestString string) string {
 		return "I can't find the last line."
 	}
 	var lastLine = requestString[indexOfLastNewline+1:]
-	fmt.Printf("lastLine = -->%s<--\n", lastLine)
+	underWrite(fmt.Sprintf("lastLine = -->%s<--\n", lastLine))
 
 	if !strings.HasPrefix(lastLine, `{"operationName":`) {
-		fmt.Printf("underlogEnabled.go FormatQuery: I can't find the operationName field.\n")
+		underWrite("underlogEnabled.go FormatQuery: I can't find the operationName field.\n")
 	}
 
 	//       That's because there is no operationName field.  Should there be one?
@@ -192,7 +237,7 @@ func FormatQuery(requestString string) string {
 	)
 	rightPortion = replacer.Replace(rightPortion)
 	lastLine = leftPortion + rightPortion
-	fmt.Printf("Revised lastLine = -->%s<--\n", lastLine)
+	underWrite(fmt.Sprintf("Revised lastLine = -->%s<--\n", lastLine))
 	// We might discover that removing all the quote marks from the query portion is
 	// too root and branch.  Change the code when we discover problems.
 	//
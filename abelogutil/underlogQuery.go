@@ -0,0 +1,254 @@
+//go:build underlog
+
+package abelogutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rhedin/Abe_common/lang/graphql/parser"
+	"github.com/rhedin/Abe_common/stringutil"
+)
+
+// Note that abelogutil now imports lang/graphql/parser.  The "noisy"
+// UnderPrintf calls in parser.go must stay commented out, since turning
+// them back on would be an import cycle.
+
+// UnderRedacted replaces the values of secret variables and arguments.
+const UnderRedacted = "<redacted>"
+
+// The settings of FormatQuery, guarded by underQueryLock.
+var (
+	underQueryLock  sync.RWMutex
+	underMaxLiteral = 80
+	underSecrets    = mustSecretFilters("*password*", "*token*", "*secret*")
+)
+
+// secretPairPattern finds name/value pairs in text which could not be
+// parsed: "name":"value" in JSON, name: "value" in a query, and the same
+// with escaped quotes in a query inside a JSON string.  Bare values like
+// numbers are matched as well.
+var secretPairPattern = regexp.MustCompile(
+	`((?:\\?")?([A-Za-z_][A-Za-z0-9_]*)(?:\\?")?\s*:\s*)` +
+		`(\\"(?:[^"\\]|\\[^"])*\\"|"(?:[^"\\]|\\.)*"|[^\s,(){}\[\]"\\]+)`)
+
+// UnderSetMaxLiteral sets the length after which FormatQuery cuts string
+// values short.  0 means values are never cut.
+func UnderSetMaxLiteral(length int) {
+	underQueryLock.Lock()
+	defer underQueryLock.Unlock()
+	underMaxLiteral = length
+}
+
+// UnderSetSecretNames sets the globs for the names of variables, arguments
+// and object fields whose values FormatQuery redacts.  The globs ignore case
+// and the default is "*password*", "*token*" and "*secret*".  Calling it
+// without globs switches redaction off.
+func UnderSetSecretNames(globs ...string) error {
+	filters, err := secretFilters(globs...)
+	if err != nil {
+		return err
+	}
+	underQueryLock.Lock()
+	defer underQueryLock.Unlock()
+	underSecrets = filters
+	return nil
+}
+
+func secretFilters(globs ...string) ([]*regexp.Regexp, error) {
+	var filters []*regexp.Regexp
+
+	for _, glob := range globs {
+		re, err := stringutil.GlobToRegex(glob)
+		if err == nil {
+			var compiled *regexp.Regexp
+			if compiled, err = regexp.Compile("(?i)^" + re + "$"); err == nil {
+				filters = append(filters, compiled)
+				continue
+			}
+		}
+		return nil, fmt.Errorf("Invalid secret name %v: %v", glob, err)
+	}
+
+	return filters, nil
+}
+
+func mustSecretFilters(globs ...string) []*regexp.Regexp {
+	filters, err := secretFilters(globs...)
+	if err != nil {
+		panic(err)
+	}
+	return filters
+}
+
+// FormatQuery takes a dumped GraphQL request, like this:
+//
+//	POST /db/v1/graphql/main HTTP/1.1
+//	Host: localhost:9090
+//	Content-Type: application/json
+//
+//	{"operationName":"","variables":{"node":{"key":"1768665757868","password":"xyz"}},"query":"\nmutation($node : NodeTemplate) {\n  general(storeNode : $node) { }\n}"}
+//
+// and returns the body (the last line), with the query run through the
+// graphql parser and its pretty printer:
+//
+//	variables: {
+//	  "node": {
+//	    "key": "1768665757868",
+//	    "password": "<redacted>"
+//	  }
+//	}
+//	query:
+//	mutation ($node: NodeTemplate) {
+//	  general(storeNode: $node) {
+//	  }
+//	}
+//
+// Long string values are cut short (see UnderSetMaxLiteral), and secret
+// values are redacted (see UnderSetSecretNames), in the variables as well
+// as in the arguments of the query.  If the body is not JSON we fall back on
+// formatQueryAdHoc.  If only the query does not parse, it is shown as it
+// came in, together with the parse error.  In both cases the values of
+// secret name/value pairs in the text are redacted first.
+func FormatQuery(requestString string) string {
+	underQueryLock.RLock()
+	defer underQueryLock.RUnlock()
+
+	lastLine := requestString
+	if i := strings.LastIndex(requestString, "\n"); i != -1 {
+		lastLine = requestString[i+1:]
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal([]byte(lastLine), &body); err != nil {
+		return formatQueryAdHoc(redactSecretPairs(requestString))
+	}
+
+	var builder strings.Builder
+
+	if name, ok := body["operationName"].(string); ok && name != "" {
+		builder.WriteString("operationName: ")
+		builder.WriteString(name)
+		builder.WriteString("\n")
+	}
+
+	if variables, ok := body["variables"].(map[string]any); ok && len(variables) > 0 {
+		encoder := json.NewEncoder(&builder)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		builder.WriteString("variables: ")
+		encoder.Encode(cleanVariables(variables))
+	}
+
+	query, _ := body["query"].(string)
+	builder.WriteString("query:\n")
+
+	ast, err := parser.Parse("query", query)
+	if err == nil {
+		cleanAST(ast)
+		var pretty string
+		if pretty, err = parser.PrettyPrint(ast); err == nil {
+			builder.WriteString(pretty)
+			return builder.String()
+		}
+	}
+
+	builder.WriteString(truncateLiteral(redactSecretPairs(strings.TrimSpace(query))))
+	builder.WriteString("\n(could not format the query: ")
+	builder.WriteString(err.Error())
+	builder.WriteString(")")
+
+	return builder.String()
+}
+
+// isSecret tells whether a name matches one of the secret name globs.
+// The caller must hold underQueryLock.
+func isSecret(name string) bool {
+	for _, secret := range underSecrets {
+		if secret.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSecretPairs redacts the values of secret name/value pairs in text
+// which could not be parsed, keeping the quotes around them.  The caller
+// must hold underQueryLock.
+func redactSecretPairs(text string) string {
+	return secretPairPattern.ReplaceAllStringFunc(text, func(pair string) string {
+		match := secretPairPattern.FindStringSubmatch(pair)
+		if !isSecret(match[2]) {
+			// The value may be a string holding further pairs, like a query.
+			return match[1] + redactSecretPairs(match[3])
+		}
+		switch value := match[3]; {
+		case strings.HasPrefix(value, `\"`):
+			return match[1] + `\"` + UnderRedacted + `\"`
+		case strings.HasPrefix(value, `"`):
+			return match[1] + `"` + UnderRedacted + `"`
+		}
+		return match[1] + UnderRedacted
+	})
+}
+
+// truncateLiteral cuts a string short if it is longer than the maximum.
+// The caller must hold underQueryLock.
+func truncateLiteral(value string) string {
+	if underMaxLiteral > 0 && len(value) > underMaxLiteral {
+		return fmt.Sprintf("%v... (%v more bytes)", value[:underMaxLiteral],
+			len(value)-underMaxLiteral)
+	}
+	return value
+}
+
+// cleanVariables redacts and truncates the values of decoded JSON
+// variables.  The caller must hold underQueryLock.
+func cleanVariables(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if isSecret(key) {
+				v[key] = UnderRedacted
+			} else {
+				v[key] = cleanVariables(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = cleanVariables(val)
+		}
+	case string:
+		return truncateLiteral(v)
+	}
+	return value
+}
+
+// cleanAST redacts and truncates the values of a parsed query.  Arguments
+// have their name in the first child, object fields in their own token.
+// The caller must hold underQueryLock.
+func cleanAST(ast *parser.ASTNode) {
+	switch {
+	case ast.Name == parser.NodeArgument && len(ast.Children) == 2 &&
+		isSecret(ast.Children[0].Token.Val):
+		ast.Children[1] = redactedNode()
+		return
+	case ast.Name == parser.NodeObjectField && len(ast.Children) == 1 &&
+		isSecret(ast.Token.Val):
+		ast.Children[0] = redactedNode()
+		return
+	case ast.Name == parser.NodeValue:
+		ast.Token.Val = truncateLiteral(ast.Token.Val)
+	}
+
+	for _, child := range ast.Children {
+		cleanAST(child)
+	}
+}
+
+func redactedNode() *parser.ASTNode {
+	return &parser.ASTNode{Name: parser.NodeValue, Token: &parser.LexToken{Val: UnderRedacted}}
+}
@@ -0,0 +1,50 @@
+//go:build underlog
+
+package abelogutil
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// The call depth of every goroutine which is inside an UnderEnter, keyed by
+// goroutine id.  A goroutine is removed again once it is back at depth 0,
+// so the map does not grow with every goroutine that ever traced something.
+var (
+	underDepthLock sync.Mutex
+	underDepths    = make(map[uint64]int)
+)
+
+// underDepth returns the current call depth of a goroutine.
+func underDepth(gid uint64) int {
+	underDepthLock.Lock()
+	defer underDepthLock.Unlock()
+	return underDepths[gid]
+}
+
+// underChangeDepth moves the call depth of a goroutine up or down.
+func underChangeDepth(gid uint64, change int) {
+	underDepthLock.Lock()
+	defer underDepthLock.Unlock()
+	if depth := underDepths[gid] + change; depth > 0 {
+		underDepths[gid] = depth
+	} else {
+		delete(underDepths, gid)
+	}
+}
+
+// goroutineID digs the id of the current goroutine out of its stack trace,
+// which starts with "goroutine 123 [running]:".  Go does not hand the id out
+// any other way.  This is slow-ish, but so is everything else in here.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
@@ -0,0 +1,252 @@
+//go:build underlog
+
+package abelogutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnderOutputControl(t *testing.T) {
+	defer UnderSetOutput(nil)
+	defer UnderFilter()
+	defer UnderSetActive(true)
+
+	var buf bytes.Buffer
+	UnderSetOutput(&buf)
+
+	UnderPrintf("hello %v\n", 1)
+	if !strings.HasSuffix(buf.String(), "hello 1\n") ||
+		!strings.Contains(buf.String(), "TestUnderOutputControl") {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Filter on the function and on the file name.
+
+	buf.Reset()
+	if err := UnderFilter("*.SomethingElse"); err != nil {
+		t.Error(err)
+		return
+	}
+	UnderPrintf("hello %v\n", 2)
+	if buf.Len() != 0 {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	if err := UnderFilter("*.SomethingElse", "*/abelogutil/underlog_test.go"); err != nil {
+		t.Error(err)
+		return
+	}
+	UnderPrintf("hello %v\n", 3)
+	if !strings.HasSuffix(buf.String(), "hello 3\n") {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	if err := UnderFilter("[abc"); err == nil || err.Error() !=
+		"Invalid underlog filter [abc: Unclosed character class at 4 of [abc" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	UnderFilter()
+
+	// Switch off at runtime.
+
+	buf.Reset()
+	UnderSetActive(false)
+	UnderPrintf("hello %v\n", 4)
+	UnderSetActive(true)
+	if buf.Len() != 0 {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Redirect to a log function.
+
+	var logged []string
+	UnderToLogger(func(msg ...any) {
+		logged = append(logged, fmt.Sprint(msg...))
+	})
+	UnderPrintf("hello %v\n", 5)
+	if len(logged) != 1 || !strings.HasSuffix(logged[0], "hello 5") {
+		t.Error("Unexpected output:", logged)
+		return
+	}
+
+	// Redirect to a file.
+
+	filename := filepath.Join(t.TempDir(), "under.log")
+	if err := UnderToFile(filename); err != nil {
+		t.Error(err)
+		return
+	}
+	UnderPrintf("hello %v\n", 6)
+	UnderSetOutput(nil)
+
+	content, err := os.ReadFile(filename)
+	if err != nil || !strings.HasSuffix(string(content), "hello 6\n") {
+		t.Error("Unexpected output:", string(content), err)
+		return
+	}
+}
+
+func underTraced(depth int) {
+	defer UnderEnter()()
+	UnderPrintf("depth %v\n", depth)
+	if depth < 2 {
+		underTraced(depth + 1)
+	}
+}
+
+func TestUnderEnter(t *testing.T) {
+	defer UnderSetOutput(nil)
+
+	var buf bytes.Buffer
+	UnderSetOutput(&buf)
+
+	underTraced(1)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	gid := fmt.Sprintf(" g%4d ", goroutineID())
+
+	for i, expected := range []string{
+		"-> enter",
+		"    depth 1",
+		"    -> enter",
+		"        depth 2",
+		"    <- exit after ",
+		"<- exit after ",
+	} {
+		if !strings.Contains(lines[i], gid) || !strings.Contains(lines[i], "underTraced") ||
+			!strings.Contains(lines[i], " "+expected) {
+			t.Error("Unexpected line:", i, lines[i])
+			return
+		}
+	}
+
+	if underDepth(goroutineID()) != 0 || len(underDepths) != 0 {
+		t.Error("Unexpected depths:", underDepths)
+		return
+	}
+
+	// Filtered out calls do not change the depth.
+
+	UnderFilter("*.SomethingElse")
+	exit := UnderEnter()
+	UnderFilter()
+
+	if underDepth(goroutineID()) != 0 {
+		t.Error("Unexpected depth:", underDepth(goroutineID()))
+		return
+	}
+	exit()
+}
+
+func TestFormatQuery(t *testing.T) {
+	defer UnderSetMaxLiteral(80)
+	defer UnderSetSecretNames("*password*", "*token*", "*secret*")
+
+	request := "POST /db/v1/graphql/main HTTP/1.1\nHost: localhost:9090\n\n" +
+		`{"operationName":"foo","variables":{"node":{"key":"123","Password":"xyz","list":["abcdefghij"]}},` +
+		`"query":"\nmutation($node : NodeTemplate) {\n  general(storeNode : $node, authToken : \"abc\", ` +
+		`msg : \"abcdefghijkl\", o : {secret : 1, a : 2}) { key }\n}"}`
+
+	UnderSetMaxLiteral(10)
+
+	if res := FormatQuery(request); res != `
+operationName: foo
+variables: {
+  "node": {
+    "Password": "<redacted>",
+    "key": "123",
+    "list": [
+      "abcdefghij"
+    ]
+  }
+}
+query:
+mutation ($node: NodeTemplate) {
+  general(storeNode: $node, authToken: "<redacted>", msg: "abcdefghij... (2 more bytes)", o: {secret : "<redacted>", a : 2}) {
+    key
+  }
+}`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Nothing is redacted or truncated if switched off.
+
+	UnderSetMaxLiteral(0)
+	UnderSetSecretNames()
+
+	if res := FormatQuery(`{"query":"{ foo(password : \"abcdefghijkl\") { key } }"}`); res != `
+query:
+{
+  foo(password: "abcdefghijkl") {
+    key
+  }
+}`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Queries which do not parse are shown as they are.
+
+	if res := FormatQuery(`{"query":"{ foo( "}`); res != `
+query:
+{ foo(
+(could not format the query: Parse error in query: Unexpected end (Line:1 Pos:7))`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Bodies which are not JSON go to the ad hoc formatting.
+
+	var buf bytes.Buffer
+	UnderSetOutput(&buf)
+	defer UnderSetOutput(nil)
+
+	if res := FormatQuery("POST / HTTP/1.1\n\n{ \"query\": foo"); res != "{\n     query:foo" {
+		t.Errorf("Unexpected result: %q", res)
+		return
+	}
+
+	// Secrets are redacted in the fallbacks as well.
+
+	UnderSetSecretNames("*password*", "*token*", "*secret*")
+	buf.Reset()
+
+	if res := FormatQuery("POST / HTTP/1.1\n\n" +
+		`{"variables":{"password":"hunter2","authToken":1234,"key":"k1"},` +
+		`"query":"{ login(userPassword: \"hunter3\", name: \"fred\") }"`); strings.Contains(res, "hunter") ||
+		strings.Contains(res, "1234") || !strings.Contains(res, "k1") || !strings.Contains(res, "fred") ||
+		strings.Contains(buf.String(), "hunter") || !strings.Contains(buf.String(), `"password":"<redacted>"`) {
+		t.Errorf("Unexpected result: %q %q", res, buf.String())
+		return
+	}
+
+	if res := FormatQuery(`{"query":"{ login(password: \"hunter2\", name: \"fred\" "}`); res != `
+query:
+{ login(password: "<redacted>", name: "fred"
+(could not format the query: Parse error in query: Unexpected end (Line:1 Pos:42))`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if err := UnderSetSecretNames("[abc"); err == nil {
+		t.Error("Broken glob should be rejected")
+		return
+	}
+}
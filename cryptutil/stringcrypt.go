@@ -12,13 +12,21 @@ package cryptutil
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 )
 
+/*
+ErrAuthentication is returned if authenticated encrypted data was modified or
+the wrong passphrase was given.
+*/
+var ErrAuthentication = errors.New("Could not authenticate data")
+
 /*
 EncryptString encrypts a given string using AES (cfb mode).
 */
@@ -107,3 +115,53 @@ func DecryptString(passphrase, text string) (string, error) {
 
 	return string(ret), err
 }
+
+/*
+EncryptStringAuthenticated encrypts a given string like EncryptString and
+appends a HMAC-SHA256 of the encrypted string. The HMAC key is derived from
+the passphrase.
+*/
+func EncryptStringAuthenticated(passphrase, text string) (string, error) {
+	ret, err := EncryptString(passphrase, text)
+
+	if err == nil {
+		ret += string(authenticationTag(passphrase, ret))
+	}
+
+	return ret, err
+}
+
+/*
+DecryptStringAuthenticated decrypts a string which was encrypted with
+EncryptStringAuthenticated. Returns ErrAuthentication if the encrypted
+string was modified or is too short.
+*/
+func DecryptStringAuthenticated(passphrase, text string) (string, error) {
+
+	// Check encrypted text
+
+	if len(text) < aes.BlockSize+sha256.Size {
+		return "", ErrAuthentication
+	}
+
+	tag := text[len(text)-sha256.Size:]
+	text = text[:len(text)-sha256.Size]
+
+	if !hmac.Equal([]byte(tag), authenticationTag(passphrase, text)) {
+		return "", ErrAuthentication
+	}
+
+	return DecryptString(passphrase, text)
+}
+
+/*
+authenticationTag calculates the HMAC of a given encrypted string.
+*/
+func authenticationTag(passphrase, text string) []byte {
+	key := sha256.Sum256([]byte("hmac:" + passphrase))
+
+	mac := hmac.New(sha256.New, (&key)[:])
+	mac.Write([]byte(text))
+
+	return mac.Sum(nil)
+}
@@ -51,3 +51,52 @@ func TestStringEncryption(t *testing.T) {
 		return
 	}
 }
+
+func TestStringAuthenticatedEncryption(t *testing.T) {
+
+	secret := "This is a test"
+
+	encString, err := EncryptStringAuthenticated("foo", secret)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decString, err := DecryptStringAuthenticated("foo", encString)
+	if err != nil || decString != secret {
+		t.Error("Unexpected result:", decString, err)
+		return
+	}
+
+	// Wrong passphrase
+
+	if _, err = DecryptStringAuthenticated("foo1", encString); err != ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Modified data
+
+	modified := []byte(encString)
+	modified[20] ^= 1
+
+	if _, err = DecryptStringAuthenticated("foo", string(modified)); err != ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = DecryptStringAuthenticated("foo", encString[1:]); err != ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = DecryptStringAuthenticated("foo1", "bar"); err != ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = DecryptStringAuthenticated("foo", ""); err != ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
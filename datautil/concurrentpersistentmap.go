@@ -0,0 +1,250 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ErrMapClosed is returned when changing or closing an already closed
+ConcurrentPersistentMap.
+*/
+var ErrMapClosed = errors.New("Map is closed")
+
+/*
+ConcurrentPersistentMap is a persistent map which can be used from multiple
+goroutines. Changes are written to disk by a background goroutine. The
+underlying PersistentMap must not be accessed directly while it is wrapped.
+*/
+type ConcurrentPersistentMap struct {
+	pm           *PersistentMap // Underlying persistent map
+	lock         *sync.RWMutex  // Lock for the data of the map
+	flushLock    *sync.Mutex    // Lock to serialize flushes
+	dirty        int32          // Flag if the map has changes which were not flushed
+	changes      uint64         // Counter for changes to detect changes during a flush
+	interval     time.Duration  // Minimum time between two background flushes
+	errorHandler func(error)    // Handler for errors of background flushes
+	changed      chan struct{}  // Signal channel for changes
+	shutdown     chan bool      // Signal channel for thread shutdown
+	closed       bool           // Flag if the map was closed
+}
+
+/*
+NewConcurrentPersistentMap wraps a given persistent map. Changes are flushed
+in the background at most once in a given interval. Errors of background
+flushes are given to an error handler which may be nil.
+*/
+func NewConcurrentPersistentMap(pm *PersistentMap, interval time.Duration,
+	errorHandler func(error)) *ConcurrentPersistentMap {
+
+	cm := &ConcurrentPersistentMap{pm, &sync.RWMutex{}, &sync.Mutex{}, 0, 0,
+		interval, errorHandler, make(chan struct{}, 1), make(chan bool), false}
+
+	go cm.flusher()
+
+	return cm
+}
+
+/*
+Get retrieves a value from the map.
+*/
+func (cm *ConcurrentPersistentMap) Get(key string) (interface{}, bool) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	v, ok := cm.pm.Data[key]
+
+	return v, ok
+}
+
+/*
+Put stores a value in the map. Returns ErrMapClosed if the map was closed.
+*/
+func (cm *ConcurrentPersistentMap) Put(key string, value interface{}) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.closed {
+		return ErrMapClosed
+	}
+
+	cm.pm.Put(key, value)
+	cm.markDirty()
+
+	return nil
+}
+
+/*
+Delete removes a value from the map. Returns ErrMapClosed if the map was
+closed.
+*/
+func (cm *ConcurrentPersistentMap) Delete(key string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.closed {
+		return ErrMapClosed
+	}
+
+	if _, ok := cm.pm.Data[key]; ok {
+		cm.pm.Delete(key)
+		cm.markDirty()
+	}
+
+	return nil
+}
+
+/*
+Size returns the number of values in the map.
+*/
+func (cm *ConcurrentPersistentMap) Size() int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	return len(cm.pm.Data)
+}
+
+/*
+Range calls a given function for every key and value in the map. Iteration
+stops if the function returns false. The function must not modify the map.
+*/
+func (cm *ConcurrentPersistentMap) Range(f func(key string, value interface{}) bool) {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	for k, v := range cm.pm.Data {
+		if !f(k, v) {
+			break
+		}
+	}
+}
+
+/*
+Dirty returns if the map has changes which were not yet written to disk.
+*/
+func (cm *ConcurrentPersistentMap) Dirty() bool {
+	return atomic.LoadInt32(&cm.dirty) == 1
+}
+
+/*
+Flush writes the contents of the map to disk if there are unwritten changes.
+The changes are copied while the map is locked and written to disk after the
+lock was released so other goroutines are not blocked by the disk.
+*/
+func (cm *ConcurrentPersistentMap) Flush() error {
+	cm.flushLock.Lock()
+	defer cm.flushLock.Unlock()
+
+	// The flush takes the changed keys from the map so it needs the write lock
+
+	cm.lock.Lock()
+
+	if atomic.LoadInt32(&cm.dirty) == 0 {
+		cm.lock.Unlock()
+		return nil
+	}
+
+	mf := cm.pm.prepareFlush(false)
+	changes := cm.changes
+
+	cm.lock.Unlock()
+
+	err := mf.write()
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if err != nil {
+		mf.restore()
+
+	} else if cm.changes == changes {
+
+		// The map is only clean if there were no changes during the write
+
+		atomic.StoreInt32(&cm.dirty, 0)
+	}
+
+	return err
+}
+
+/*
+Close stops the background flushing and writes all remaining changes to disk.
+*/
+func (cm *ConcurrentPersistentMap) Close() error {
+	cm.lock.Lock()
+
+	if cm.closed {
+		cm.lock.Unlock()
+		return ErrMapClosed
+	}
+
+	cm.closed = true
+
+	cm.lock.Unlock()
+
+	cm.shutdown <- true
+	<-cm.shutdown
+
+	return cm.Flush()
+}
+
+/*
+markDirty marks the map as changed. The caller must hold the write lock.
+*/
+func (cm *ConcurrentPersistentMap) markDirty() {
+	cm.changes++
+	atomic.StoreInt32(&cm.dirty, 1)
+
+	select {
+	case cm.changed <- struct{}{}:
+	default:
+	}
+}
+
+/*
+flusher is the background goroutine which flushes the map after changes.
+*/
+func (cm *ConcurrentPersistentMap) flusher() {
+	for {
+		select {
+		case <-cm.shutdown:
+			close(cm.shutdown)
+			return
+		case <-cm.changed:
+		}
+
+		if err := cm.Flush(); err != nil {
+
+			// Try again after the interval
+
+			select {
+			case cm.changed <- struct{}{}:
+			default:
+			}
+
+			if cm.errorHandler != nil {
+				cm.errorHandler(err)
+			}
+		}
+
+		// Wait for the interval before the next flush
+
+		select {
+		case <-cm.shutdown:
+			close(cm.shutdown)
+			return
+		case <-time.After(cm.interval):
+		}
+	}
+}
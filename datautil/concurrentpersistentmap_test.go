@@ -0,0 +1,184 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentPersistentMap(t *testing.T) {
+	filename := testdbdir + "/testconcurrentmap.map"
+
+	pm, err := NewPersistentMap(filename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm := NewConcurrentPersistentMap(pm, 10*time.Millisecond, nil)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprint(i, "-", j)
+
+				cm.Put(key, j)
+
+				if v, ok := cm.Get(key); !ok || v != j {
+					t.Error("Unexpected result:", v, ok)
+				}
+
+				if j%2 == 0 {
+					cm.Delete(key)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if res := cm.Size(); res != 500 {
+		t.Error("Unexpected size:", res)
+		return
+	}
+
+	// Changes are written in the background
+
+	for i := 0; cm.Dirty() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pm2, err := LoadPersistentMap(filename)
+	if err != nil || len(pm2.Data) != 500 || pm2.Data["3-99"] != 99 {
+		t.Error("Unexpected result:", len(pm2.Data), err)
+		return
+	}
+
+	count := 0
+	cm.Range(func(key string, value interface{}) bool {
+		count++
+		return count < 10
+	})
+
+	if count != 10 {
+		t.Error("Unexpected count:", count)
+		return
+	}
+
+	// Close writes remaining changes
+
+	cm.Put("last", "value")
+
+	if err := cm.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm2, _ = LoadPersistentMap(filename)
+
+	if len(pm2.Data) != 501 || pm2.Data["last"] != "value" || cm.Dirty() {
+		t.Error("Unexpected result:", len(pm2.Data))
+		return
+	}
+
+	if err := cm.Close(); err != ErrMapClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Changes after Close are rejected
+
+	if err := cm.Put("late", "value"); err != ErrMapClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := cm.Delete("last"); err != ErrMapClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if v, ok := cm.Get("last"); !ok || v != "value" || cm.Size() != 501 {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	// Test error reporting
+
+	errs := make(chan error, 10)
+
+	cm = NewConcurrentPersistentMap(&PersistentMap{invalidFileName,
+		make(map[string]interface{}), PersistentMapOptions{}, nil}, time.Millisecond,
+		func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+	cm.Put("test", 1)
+
+	if err := <-errs; err == nil {
+		t.Error("Error expected")
+		return
+	}
+
+	if err := cm.Close(); err == nil || !cm.Dirty() {
+		t.Error("Error expected")
+		return
+	}
+
+	// Changes of a failed flush are written to the log by the next flush
+
+	filename = filepath.Join(t.TempDir(), "testconcurrentwal.map")
+
+	pm, err = NewPersistentMapWithOptions(filename, PersistentMapOptions{WAL: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	walFilename := pm.wal.filename
+	pm.wal.filename = invalidFileName
+
+	cm = NewConcurrentPersistentMap(pm, time.Hour, nil)
+
+	cm.Put("test", 1)
+
+	if err := cm.Flush(); err == nil || !cm.Dirty() {
+		t.Error("Error expected")
+		return
+	}
+
+	cm.flushLock.Lock()
+	pm.wal.filename = walFilename
+	cm.flushLock.Unlock()
+
+	if err := cm.Close(); err != nil || cm.Dirty() {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if pm2, err = LoadPersistentMapWithOptions(filename, PersistentMapOptions{WAL: true}); err != nil ||
+		pm2.Data["test"] != 1 {
+		t.Error("Unexpected result:", pm2.Data, err)
+		return
+	}
+}
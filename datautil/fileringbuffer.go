@@ -0,0 +1,493 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+ErrRecordTooLarge is returned if an item does not fit into a record of a
+FileRingBuffer.
+*/
+var ErrRecordTooLarge = errors.New("Record too large")
+
+/*
+fileRingBufferMagic identifies the header of a FileRingBuffer file.
+*/
+const fileRingBufferMagic = "ABERING1"
+
+/*
+Layout of a FileRingBuffer file. The file starts with two header slots which
+are written alternately. Each header has a sequence number and a checksum so
+the latest complete header can be found after a crash. The headers are
+followed by a fixed number of record slots. Each record slot consists of
+the length and checksum of the record followed by the gob encoded record.
+*/
+const (
+	fileRingBufferHeaderSize       = 64
+	fileRingBufferRecordsOffset    = 2 * fileRingBufferHeaderSize
+	fileRingBufferRecordHeaderSize = 8
+)
+
+/*
+fileRingBufferRecord is a single record of a FileRingBuffer.
+*/
+type fileRingBufferRecord struct {
+	Value interface{} // Value of the record
+}
+
+/*
+FileRingBuffer is a thread-safe ringbuffer which is backed by a file of a
+fixed size. It has the same API as RingBuffer (see RingBufferInterface) so it
+can be used as a print logger which survives restarts. All items are also kept
+in memory.
+
+Items are gob encoded and must fit into the record size of the buffer. Custom
+types must be registered with gob.Register. Each added record is synced to
+disk before the header refers to it. Write errors are kept and returned by
+Flush and Close.
+*/
+type FileRingBuffer struct {
+	file       *os.File      // File of the ring buffer
+	data       []interface{} // Elements of this ring buffer
+	recordSize int           // Maximum size of an encoded item
+	size       int           // Size of the ring buffer
+	first      int           // First item of the ring buffer
+	seq        uint64        // Sequence number of the last written header
+	err        error         // First error which occurred when writing
+	lock       *sync.RWMutex // Lock for FileRingBuffer
+}
+
+/*
+Make sure FileRingBuffer implements the common ringbuffer API.
+*/
+var _ RingBufferInterface = &FileRingBuffer{}
+
+/*
+NewFileRingBuffer creates a new ringbuffer with a given size in a given file.
+Each item can take up to recordSize bytes when encoded. An existing file is
+overwritten.
+*/
+func NewFileRingBuffer(filename string, size int, recordSize int) (*FileRingBuffer, error) {
+	if size <= 0 || recordSize <= 0 {
+		return nil, fmt.Errorf("Invalid file ring buffer size: %v records of %v bytes", size, recordSize)
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	rb := &FileRingBuffer{file, make([]interface{}, size), recordSize, 0, 0, 0, nil, &sync.RWMutex{}}
+
+	// Allocate the whole file and write both headers
+
+	if err = file.Truncate(rb.fileSize()); err == nil {
+		if err = rb.writeHeader(); err == nil {
+			err = rb.writeHeader()
+		}
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return rb, nil
+}
+
+/*
+LoadFileRingBuffer loads a ringbuffer from a given file. A partly written last
+record is discarded. Returns an error if any other record is corrupt.
+*/
+func LoadFileRingBuffer(filename string) (*FileRingBuffer, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	rb, err := loadFileRingBuffer(file)
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return rb, nil
+}
+
+/*
+loadFileRingBuffer reads the header and all records of a given file.
+*/
+func loadFileRingBuffer(file *os.File) (*FileRingBuffer, error) {
+	var header []byte
+
+	// Find the latest valid header
+
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, fileRingBufferHeaderSize)
+
+		if _, err := file.ReadAt(buf, int64(i*fileRingBufferHeaderSize)); err != nil {
+			continue
+		}
+
+		if !bytes.Equal(buf[:8], []byte(fileRingBufferMagic)) ||
+			crc32.ChecksumIEEE(buf[:32]) != binary.BigEndian.Uint32(buf[32:]) {
+			continue
+		}
+
+		if header == nil || binary.BigEndian.Uint64(buf[24:]) > binary.BigEndian.Uint64(header[24:]) {
+			header = buf
+		}
+	}
+
+	if header == nil {
+		return nil, fmt.Errorf("Invalid file ring buffer: %v", file.Name())
+	}
+
+	slots := int(binary.BigEndian.Uint32(header[8:]))
+
+	rb := &FileRingBuffer{file, make([]interface{}, slots), int(binary.BigEndian.Uint32(header[12:])),
+		int(binary.BigEndian.Uint32(header[20:])), int(binary.BigEndian.Uint32(header[16:])),
+		binary.BigEndian.Uint64(header[24:]), nil, &sync.RWMutex{}}
+
+	if slots == 0 || rb.first >= slots || rb.size > slots {
+		return nil, fmt.Errorf("Invalid file ring buffer: %v", file.Name())
+	}
+
+	// Read all records - a partly written record at the end is discarded
+
+	for i := 0; i < rb.size; i++ {
+		p := (rb.first + i) % slots
+		v, err := rb.readRecord(p)
+
+		if err != nil {
+			if i == rb.size-1 {
+				rb.size--
+				break
+			}
+
+			return nil, fmt.Errorf("Invalid file ring buffer: %v (%v)", file.Name(), err)
+		}
+
+		rb.data[p] = v
+	}
+
+	return rb, nil
+}
+
+/*
+Reset removes all content from the ringbuffer.
+*/
+func (rb *FileRingBuffer) Reset() {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	rb.data = make([]interface{}, len(rb.data))
+	rb.size = 0
+	rb.first = 0
+
+	rb.setError(rb.writeHeader())
+}
+
+/*
+IsEmpty returns if this ringbuffer is empty.
+*/
+func (rb *FileRingBuffer) IsEmpty() bool {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	return rb.size == 0
+}
+
+/*
+Size returns the size of the ringbuffer.
+*/
+func (rb *FileRingBuffer) Size() int {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	return rb.size
+}
+
+/*
+Get returns an element of the ringbuffer from a given position.
+*/
+func (rb *FileRingBuffer) Get(p int) interface{} {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	return rb.data[(rb.first+p)%len(rb.data)]
+}
+
+/*
+Add adds an item to the ringbuffer. The item is not added if it cannot be
+encoded or if it is larger than the record size.
+*/
+func (rb *FileRingBuffer) Add(e interface{}) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	record, err := rb.encodeRecord(e)
+	if err != nil {
+		rb.setError(err)
+		return
+	}
+
+	ld := len(rb.data)
+
+	if rb.size == ld {
+
+		// Drop the oldest item first so a crash while writing the record
+		// cannot make the new record appear as the oldest item
+
+		rb.data[rb.first] = nil
+		rb.first = (rb.first + 1) % ld
+		rb.size--
+
+		if err = rb.writeHeader(); err != nil {
+			rb.setError(err)
+			return
+		}
+	}
+
+	p := (rb.first + rb.size) % ld
+
+	// The record must be on disk before the header refers to it
+
+	if _, err = rb.file.WriteAt(record, rb.recordOffset(p)); err == nil {
+		if err = rb.file.Sync(); err == nil {
+			rb.data[p] = e
+			rb.size++
+
+			err = rb.writeHeader()
+		}
+	}
+
+	rb.setError(err)
+}
+
+/*
+Poll removes and returns the head of the ringbuffer.
+*/
+func (rb *FileRingBuffer) Poll() interface{} {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	if rb.size == 0 {
+		return nil
+	}
+
+	i := rb.data[rb.first]
+	rb.data[rb.first] = nil
+
+	rb.size--
+	rb.first = (rb.first + 1) % len(rb.data)
+
+	rb.setError(rb.writeHeader())
+
+	return i
+}
+
+/*
+Log writes the given arguments as strings into the ring buffer. Each line is a
+separate item.
+*/
+func (rb *FileRingBuffer) Log(v ...interface{}) {
+	lines := strings.Split(fmt.Sprint(v...), "\n")
+
+	for _, line := range lines {
+		rb.Add(line)
+	}
+}
+
+/*
+Slice returns the contents of the buffer as a slice.
+*/
+func (rb *FileRingBuffer) Slice() []interface{} {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	ld := len(rb.data)
+	ret := make([]interface{}, rb.size)
+
+	for i := 0; i < rb.size; i++ {
+		ret[i] = rb.data[(i+rb.first)%ld]
+	}
+
+	return ret
+}
+
+/*
+StringSlice returns the contents of the buffer as a slice of strings.
+Each item of the buffer is a separate string.
+*/
+func (rb *FileRingBuffer) StringSlice() []string {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	ld := len(rb.data)
+	ret := make([]string, rb.size)
+
+	for i := 0; i < rb.size; i++ {
+		ret[i] = fmt.Sprint(rb.data[(i+rb.first)%ld])
+	}
+
+	return ret
+}
+
+/*
+String returns the contents of the buffer as a string. Each item of the buffer
+is treated as a separate line.
+*/
+func (rb *FileRingBuffer) String() string {
+	return strings.Join(rb.StringSlice(), "\n")
+}
+
+/*
+Flush writes all changes to disk. Returns the first error which occurred
+since the last flush.
+*/
+func (rb *FileRingBuffer) Flush() error {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	err := rb.err
+	rb.err = nil
+
+	if serr := rb.file.Sync(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+/*
+Close writes all changes to disk and closes the file of the ringbuffer.
+*/
+func (rb *FileRingBuffer) Close() error {
+	err := rb.Flush()
+
+	if cerr := rb.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+/*
+setError records the first error which occurred. The caller must hold the
+writer lock.
+*/
+func (rb *FileRingBuffer) setError(err error) {
+	if rb.err == nil {
+		rb.err = err
+	}
+}
+
+/*
+fileSize returns the size of the file of the ringbuffer.
+*/
+func (rb *FileRingBuffer) fileSize() int64 {
+	return rb.recordOffset(len(rb.data))
+}
+
+/*
+recordOffset returns the file offset of a given record slot.
+*/
+func (rb *FileRingBuffer) recordOffset(p int) int64 {
+	return fileRingBufferRecordsOffset +
+		int64(p)*int64(rb.recordSize+fileRingBufferRecordHeaderSize)
+}
+
+/*
+writeHeader writes the current state of the ringbuffer into the older of the
+two header slots. The caller must hold the writer lock.
+*/
+func (rb *FileRingBuffer) writeHeader() error {
+	buf := make([]byte, fileRingBufferHeaderSize)
+
+	rb.seq++
+
+	copy(buf, fileRingBufferMagic)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(rb.data)))
+	binary.BigEndian.PutUint32(buf[12:], uint32(rb.recordSize))
+	binary.BigEndian.PutUint32(buf[16:], uint32(rb.first))
+	binary.BigEndian.PutUint32(buf[20:], uint32(rb.size))
+	binary.BigEndian.PutUint64(buf[24:], rb.seq)
+	binary.BigEndian.PutUint32(buf[32:], crc32.ChecksumIEEE(buf[:32]))
+
+	_, err := rb.file.WriteAt(buf, int64(rb.seq%2)*fileRingBufferHeaderSize)
+
+	return err
+}
+
+/*
+encodeRecord encodes a given item into a record.
+*/
+func (rb *FileRingBuffer) encodeRecord(e interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.Write(make([]byte, fileRingBufferRecordHeaderSize))
+
+	if err := gob.NewEncoder(&buf).Encode(fileRingBufferRecord{e}); err != nil {
+		return nil, err
+	}
+
+	record := buf.Bytes()
+	data := record[fileRingBufferRecordHeaderSize:]
+
+	if len(data) > rb.recordSize {
+		return nil, ErrRecordTooLarge
+	}
+
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+
+	return record, nil
+}
+
+/*
+readRecord reads and decodes the record of a given slot.
+*/
+func (rb *FileRingBuffer) readRecord(p int) (interface{}, error) {
+	var record fileRingBufferRecord
+
+	buf := make([]byte, rb.recordSize+fileRingBufferRecordHeaderSize)
+
+	if _, err := rb.file.ReadAt(buf, rb.recordOffset(p)); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(buf)
+
+	if l > uint32(rb.recordSize) {
+		return nil, fmt.Errorf("Invalid record length: %v", l)
+	}
+
+	data := buf[fileRingBufferRecordHeaderSize : fileRingBufferRecordHeaderSize+l]
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[4:]) {
+		return nil, fmt.Errorf("Invalid record checksum in slot %v", p)
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+
+	return record.Value, err
+}
@@ -0,0 +1,178 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileRingBuffer(t *testing.T) {
+	filename := testdbdir + "/testringbuffer.rb"
+
+	if _, err := NewFileRingBuffer(filename, 0, 10); err == nil {
+		t.Error("Error expected")
+		return
+	}
+
+	rb, err := NewFileRingBuffer(filename, 3, 64)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !rb.IsEmpty() || rb.Poll() != nil {
+		t.Error("Initial buffer should be empty")
+		return
+	}
+
+	rb.Add("AAA")
+	rb.Add(5)
+	rb.Log("BBB\nCCC")
+
+	if res := fmt.Sprint(rb.Slice()); res != "[5 BBB CCC]" || rb.Get(0) != 5 || rb.Size() != 3 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if err := rb.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if fi, _ := os.Stat(filename); fi.Size() != 128+3*72 {
+		t.Error("Unexpected file size:", fi.Size())
+		return
+	}
+
+	// Contents survive a restart
+
+	rb, err = LoadFileRingBuffer(filename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := rb.String(); res != "5\nBBB\nCCC" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := rb.Poll(); res != 5 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	rb.Add("DDD")
+
+	// Items which are too large are not added
+
+	rb.Add(strings.Repeat("x", 100))
+
+	if err := rb.Flush(); err != ErrRecordTooLarge {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	rb.Close()
+
+	rb, _ = LoadFileRingBuffer(filename)
+
+	if res := fmt.Sprint(rb.StringSlice()); res != "[BBB CCC DDD]" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	rb.Reset()
+	rb.Close()
+
+	rb, _ = LoadFileRingBuffer(filename)
+
+	if !rb.IsEmpty() {
+		t.Error("Buffer should be empty")
+		return
+	}
+
+	rb.Close()
+
+	// Test loading errors
+
+	if _, err := LoadFileRingBuffer(invalidFileName); err == nil {
+		t.Error("Error expected")
+		return
+	}
+
+	os.WriteFile(testdbdir+"/testinvalid.rb", []byte("test"), 0660)
+
+	if _, err := LoadFileRingBuffer(testdbdir + "/testinvalid.rb"); err == nil ||
+		err.Error() != "Invalid file ring buffer: test/testinvalid.rb" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestFileRingBufferCrash(t *testing.T) {
+	filename := testdbdir + "/testringbuffercrash.rb"
+
+	rb, _ := NewFileRingBuffer(filename, 3, 64)
+
+	rb.Log("AAA\nBBB\nCCC")
+
+	// Simulate a partly written record at the end
+
+	rb.file.WriteAt([]byte("xx"), rb.recordOffset(2)+8)
+	rb.Close()
+
+	rb, err := LoadFileRingBuffer(filename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := rb.String(); res != "AAA\nBBB" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	rb.Add("DDD")
+	rb.Add("EEE")
+
+	// Simulate a partly written header - the other header is used which
+	// was written after the oldest item was dropped for the new item
+
+	seq := rb.seq
+
+	rb.file.WriteAt([]byte("xx"), int64(seq%2)*fileRingBufferHeaderSize+16)
+	rb.Close()
+
+	rb, err = LoadFileRingBuffer(filename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := rb.String(); res != "BBB\nDDD" || rb.seq != seq-1 {
+		t.Error("Unexpected result:", res, rb.seq)
+		return
+	}
+
+	// A corrupt record which is not the last one is reported
+
+	rb.file.WriteAt([]byte("xx"), rb.recordOffset(rb.first)+8)
+	rb.Close()
+
+	if _, err = LoadFileRingBuffer(filename); err == nil ||
+		!strings.Contains(err.Error(), "Invalid record checksum in slot 1") {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
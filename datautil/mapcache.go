@@ -11,121 +11,391 @@ package datautil
 
 import (
 	"bytes"
+	"container/heap"
+	"container/list"
 	"fmt"
-	"math"
 	"sort"
 	"sync"
 	"time"
 )
 
 /*
-MapCache is a map based cache object storing string->interface{}. It is possible
+EvictionPolicy determines which entry a MapCache removes when it is full.
+*/
+type EvictionPolicy int
+
+/*
+Eviction policies
+*/
+const (
+	EvictFIFO EvictionPolicy = iota // Remove the entry which was put least recently
+	EvictLRU                        // Remove the entry which was put or retrieved least recently
+)
+
+/*
+EvictionReason is the reason why an entry was removed from a MapCache.
+*/
+type EvictionReason int
+
+/*
+Eviction reasons
+*/
+const (
+	EvictionExpired EvictionReason = iota // Entry has expired
+	EvictionSize                          // Entry was removed to make room for a new entry
+	EvictionRemoved                       // Entry was removed explicitly
+	EvictionCleared                       // Cache was cleared
+)
+
+/*
+String returns a string representation of an eviction reason.
+*/
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionSize:
+		return "size"
+	case EvictionRemoved:
+		return "removed"
+	case EvictionCleared:
+		return "cleared"
+	}
+	return fmt.Sprintf("EvictionReason(%d)", int(r))
+}
+
+/*
+MapCacheStats are statistics of a MapCache.
+*/
+type MapCacheStats struct {
+	Hits      uint64                    // Number of successful lookups
+	Misses    uint64                    // Number of unsuccessful lookups
+	Evictions map[EvictionReason]uint64 // Number of removed entries by reason
+	Size      uint64                    // Current size of the cache
+	Cost      uint64                    // Current total cost of all entries
+}
+
+/*
+MapCache is a map based cache object storing string->interface{}.
+*/
+type MapCache = TypedMapCache[string, interface{}]
+
+/*
+TypedMapCache is a map based cache object storing values of a given type
+under keys of a given type. It is possible
 to specify a maximum size, which when reached causes the oldest entries to be
 removed. It is also possible to set an expiry time for values. Values which are
-old are purged on the next access to the object.
+old are purged on the next access to the object. If a cost function is set the
+maximum size is a budget for the total cost of all entries.
+
+All entries are kept in a map and in two linked lists - one in eviction order
+and one in the order in which they were put. All operations except GetAll and
+String are O(1) (expired entries are purged from the front of the put order
+list). Entries which were put with their own TTL are kept in a heap ordered
+by expiry time instead of the put order list, operations on these entries
+are O(log n).
+*/
+type TypedMapCache[K comparable, V any] struct {
+	data    map[K]*mapCacheEntry[K, V] // Data for the cache
+	order   *list.List                 // Entries in eviction order (front is evicted first)
+	age     *list.List                 // Entries in put order (front is the oldest)
+	ttls    mapCacheTTLs[K, V]         // Entries with their own TTL (heap ordered by expiry time)
+	size    uint64                     // Size of the cache
+	cost    uint64                     // Total cost of all entries
+	maxsize uint64                     // Max size or cost budget of the cache
+	maxage  int64                      // Max age of the cache
+	policy  EvictionPolicy             // Eviction policy of the cache
+	mutex   *sync.RWMutex              // Mutex to protect atomic map operations
+
+	costFunc  func(K, V) uint64          // Function which calculates the cost of entries
+	onEvict   func(K, V, EvictionReason) // Callback for removed entries
+	evicted   []*mapCacheEntry[K, V]     // Removed entries which have not been reported
+	hits      uint64                     // Number of successful lookups
+	misses    uint64                     // Number of unsuccessful lookups
+	evictions [4]uint64                  // Number of removed entries by reason
+}
+
+/*
+mapCacheEntry is a single entry of a MapCache.
 */
-type MapCache struct {
-	data    map[string]interface{} // Data for the cache
-	ts      map[string]int64       // Timestamps for values
-	size    uint64                 // Size of the cache
-	maxsize uint64                 // Max size of the cache
-	maxage  int64                  // Max age of the cache
-	mutex   *sync.RWMutex          // Mutex to protect atomic map operations
+type mapCacheEntry[K comparable, V any] struct {
+	key      K              // Key of the entry
+	value    V              // Value of the entry
+	cost     uint64         // Cost of the entry
+	ts       int64          // Timestamp of the last put
+	deadline int64          // Expiry time in nanoseconds (entries with their own TTL)
+	order    *list.Element  // Element of the entry in the eviction order list
+	age      *list.Element  // Element of the entry in the put order list (nil for entries with their own TTL)
+	ttlIndex int            // Index of the entry in the TTL heap (-1 if not in the heap)
+	reason   EvictionReason // Reason why the entry was removed
 }
 
 /*
 NewMapCache creates a new MapCache object. The calling function can specify
 the maximum size and the maximum age in seconds for entries. A value of 0
-means no size constraint and no age constraint.
+means no size constraint and no age constraint. The cache removes the entry
+which was put least recently when it is full.
 */
 func NewMapCache(maxsize uint64, maxage int64) *MapCache {
-	return &MapCache{make(map[string]interface{}), make(map[string]int64),
-		0, maxsize, maxage, &sync.RWMutex{}}
+	return NewTypedMapCacheWithPolicy[string, interface{}](maxsize, maxage, EvictFIFO)
 }
 
 /*
-Clear removes all entries.
+NewMapCacheWithPolicy creates a new MapCache object with a given eviction policy.
 */
-func (mc *MapCache) Clear() {
+func NewMapCacheWithPolicy(maxsize uint64, maxage int64, policy EvictionPolicy) *MapCache {
+	return NewTypedMapCacheWithPolicy[string, interface{}](maxsize, maxage, policy)
+}
 
-	// Take writer lock
+/*
+NewTypedMapCache creates a new TypedMapCache object. The parameters are the
+same as for NewMapCache.
+*/
+func NewTypedMapCache[K comparable, V any](maxsize uint64, maxage int64) *TypedMapCache[K, V] {
+	return NewTypedMapCacheWithPolicy[K, V](maxsize, maxage, EvictFIFO)
+}
+
+/*
+NewTypedMapCacheWithPolicy creates a new TypedMapCache object with a given
+eviction policy.
+*/
+func NewTypedMapCacheWithPolicy[K comparable, V any](maxsize uint64, maxage int64,
+	policy EvictionPolicy) *TypedMapCache[K, V] {
+
+	return &TypedMapCache[K, V]{make(map[K]*mapCacheEntry[K, V]), list.New(), list.New(), nil,
+		0, 0, maxsize, maxage, policy, &sync.RWMutex{}, nil, nil, nil, 0, 0, [4]uint64{}}
+}
+
+/*
+SetCostFunc sets a function which calculates the cost of an entry (e.g. its
+size in bytes). The maximum size of the cache becomes a budget for the total
+cost of all entries. Entries are removed until the budget is met - an entry
+which costs more than the whole budget is not kept at all.
+*/
+func (mc *TypedMapCache[K, V]) SetCostFunc(costFunc func(key K, value V) uint64) {
+	mc.mutex.Lock()
+	defer mc.unlock()
+
+	mc.costFunc = costFunc
+	mc.cost = 0
+
+	for _, e := range mc.data {
+		e.cost = mc.entryCost(e.key, e.value)
+		mc.cost += e.cost
+	}
 
+	mc.enforceBudget()
+}
+
+/*
+Cost returns the current total cost of all entries. This is the same as the
+size if no cost function is set.
+*/
+func (mc *TypedMapCache[K, V]) Cost() uint64 {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	return mc.cost
+}
+
+/*
+SetOnEvict sets a callback which is called with key, value and reason for
+every entry which is removed from the cache. The callback is called after
+the cache operation has finished so it may access the cache.
+*/
+func (mc *TypedMapCache[K, V]) SetOnEvict(onEvict func(key K, value V, reason EvictionReason)) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
 
-	mc.data = make(map[string]interface{})
-	mc.ts = make(map[string]int64)
+	mc.onEvict = onEvict
+}
+
+/*
+Stats returns statistics of the MapCache.
+*/
+func (mc *TypedMapCache[K, V]) Stats() MapCacheStats {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	evictions := make(map[EvictionReason]uint64)
+
+	for r, c := range mc.evictions {
+		evictions[EvictionReason(r)] = c
+	}
+
+	return MapCacheStats{mc.hits, mc.misses, evictions, mc.size, mc.cost}
+}
+
+/*
+Clear removes all entries.
+*/
+func (mc *TypedMapCache[K, V]) Clear() {
+
+	// Take writer lock
+
+	mc.mutex.Lock()
+	defer mc.unlock()
 
-	mc.size = 0
+	for front := mc.order.Front(); front != nil; front = mc.order.Front() {
+		mc.removeEntry(front.Value.(*mapCacheEntry[K, V]), EvictionCleared)
+	}
 }
 
 /*
 Size returns the current size of the MapCache.
 */
-func (mc *MapCache) Size() uint64 {
+func (mc *TypedMapCache[K, V]) Size() uint64 {
 	return mc.size
 }
 
 /*
 Put stores an item in the MapCache.
 */
-func (mc *MapCache) Put(k string, v interface{}) {
+func (mc *TypedMapCache[K, V]) Put(k K, v V) {
 
-	// Do cache maintenance
+	// Take writer lock
+
+	mc.mutex.Lock()
+	defer mc.unlock()
+
+	mc.put(k, v, time.Now(), 0, false)
+}
 
-	oldest := mc.maintainCache()
+/*
+PutWithTTL stores an item in the MapCache which expires after a given time
+instead of the maximum age of the cache. A ttl of 0 means that the item does
+not expire.
+*/
+func (mc *TypedMapCache[K, V]) PutWithTTL(k K, v V, ttl time.Duration) {
 
 	// Take writer lock
 
 	mc.mutex.Lock()
-	defer mc.mutex.Unlock()
+	defer mc.unlock()
+
+	mc.put(k, v, time.Now(), ttl, true)
+}
 
-	// Check if the entry is a new entry
+/*
+put stores an item in the MapCache. The caller must hold the writer lock.
+*/
+func (mc *TypedMapCache[K, V]) put(k K, v V, now time.Time, ttl time.Duration, hasTTL bool) {
+
+	// Do cache maintenance
+
+	mc.expire(now)
 
-	if _, exists := mc.data[k]; !exists {
+	// Check if the entry is an existing entry
 
-		// If the list is full remove the oldest item otherwise increase the size
+	e, exists := mc.data[k]
 
-		if mc.maxsize != 0 && mc.size == mc.maxsize {
-			delete(mc.data, oldest)
-			delete(mc.ts, oldest)
+	if exists {
+		mc.cost -= e.cost
+		e.value = v
+
+		mc.order.MoveToBack(e.order)
+
+	} else {
+
+		// Do the actual map operation
+
+		e = &mapCacheEntry[K, V]{k, v, 0, 0, 0, nil, nil, -1, 0}
+		e.order = mc.order.PushBack(e)
+
+		mc.data[k] = e
+		mc.size++
+	}
+
+	e.cost = mc.entryCost(k, v)
+	mc.cost += e.cost
+
+	// Put the entry in the put order list or in the TTL heap
+
+	e.ts = now.Unix()
+
+	if !hasTTL {
+
+		if e.ttlIndex != -1 {
+			heap.Remove(&mc.ttls, e.ttlIndex)
+		}
+
+		if e.age == nil {
+			e.age = mc.age.PushBack(e)
+		} else {
+			mc.age.MoveToBack(e.age)
+		}
+
+	} else {
+
+		if e.age != nil {
+			mc.age.Remove(e.age)
+			e.age = nil
+		}
+
+		if ttl <= 0 {
+			if e.ttlIndex != -1 {
+				heap.Remove(&mc.ttls, e.ttlIndex)
+			}
 		} else {
-			mc.size++
+			e.deadline = now.Add(ttl).UnixNano()
+
+			if e.ttlIndex == -1 {
+				heap.Push(&mc.ttls, e)
+			} else {
+				heap.Fix(&mc.ttls, e.ttlIndex)
+			}
 		}
 	}
 
-	// Do the actual map operation
+	// If the cache is full remove the oldest items
 
-	mc.data[k] = v
-	mc.ts[k] = time.Now().Unix()
+	mc.enforceBudget()
 }
 
 /*
-Remove removes an item in the MapCache.
+entryCost calculates the cost of an entry. The caller must hold the writer lock.
 */
-func (mc *MapCache) Remove(k string) bool {
+func (mc *TypedMapCache[K, V]) entryCost(k K, v V) uint64 {
+	if mc.costFunc == nil {
+		return 1
+	}
 
-	// Do cache maintenance
+	return mc.costFunc(k, v)
+}
+
+/*
+enforceBudget removes entries in eviction order until the total cost is within
+the maximum size. The caller must hold the writer lock.
+*/
+func (mc *TypedMapCache[K, V]) enforceBudget() {
+	for mc.maxsize != 0 && mc.cost > mc.maxsize {
+		mc.removeEntry(mc.order.Front().Value.(*mapCacheEntry[K, V]), EvictionSize)
+	}
+}
 
-	mc.maintainCache()
+/*
+Remove removes an item in the MapCache.
+*/
+func (mc *TypedMapCache[K, V]) Remove(k K) bool {
 
 	// Take writer lock
 
 	mc.mutex.Lock()
-	defer mc.mutex.Unlock()
+	defer mc.unlock()
+
+	// Do cache maintenance
+
+	mc.expire(time.Now())
 
 	// Check if the entry exists
 
-	_, exists := mc.data[k]
+	e, exists := mc.data[k]
 
 	if exists {
 
 		// Do the actual map operation
 
-		delete(mc.data, k)
-		delete(mc.ts, k)
-
-		mc.size--
+		mc.removeEntry(e, EvictionRemoved)
 	}
 
 	return exists
@@ -134,44 +404,58 @@ func (mc *MapCache) Remove(k string) bool {
 /*
 Get retrieves an item from the MapCache.
 */
-func (mc *MapCache) Get(k string) (interface{}, bool) {
+func (mc *TypedMapCache[K, V]) Get(k K) (V, bool) {
 
-	// Do cache maintenance
+	// Take writer lock - expired entries are removed and the eviction
+	// order is updated
 
-	mc.maintainCache()
+	mc.mutex.Lock()
+	defer mc.unlock()
 
-	// Take reader lock
+	// Do cache maintenance
 
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+	mc.expire(time.Now())
 
 	// Do the actual map operation
 
-	v, ok := mc.data[k]
+	e, ok := mc.data[k]
+
+	if !ok {
+		var zero V
+
+		mc.misses++
+		return zero, false
+	}
+
+	mc.hits++
 
-	return v, ok
+	if mc.policy == EvictLRU {
+		mc.order.MoveToBack(e.order)
+	}
+
+	return e.value, true
 }
 
 /*
 GetAll retrieves all items from the MapCache.
 */
-func (mc *MapCache) GetAll() map[string]interface{} {
+func (mc *TypedMapCache[K, V]) GetAll() map[K]V {
 
-	// Do cache maintenance
+	// Take writer lock
 
-	mc.maintainCache()
+	mc.mutex.Lock()
+	defer mc.unlock()
 
-	// Take reader lock
+	// Do cache maintenance
 
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+	mc.expire(time.Now())
 
 	// Create return map
 
-	cp := make(map[string]interface{})
+	cp := make(map[K]V)
 
-	for k, v := range mc.data {
-		cp[k] = v
+	for k, e := range mc.data {
+		cp[k] = e.value
 	}
 
 	return cp
@@ -180,67 +464,144 @@ func (mc *MapCache) GetAll() map[string]interface{} {
 /*
 String returns a string representation of this MapCache.
 */
-func (mc *MapCache) String() string {
+func (mc *TypedMapCache[K, V]) String() string {
 
 	mc.mutex.RLock()
 	defer mc.mutex.RUnlock()
 
-	// Sort keys before printing the map
+	// Sort keys by their string representation before printing the map
 
-	var keys []string
+	var keys []K
 	for k := range mc.data {
 		keys = append(keys, k)
 	}
-	sort.Sort(sort.StringSlice(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
 
 	buf := &bytes.Buffer{}
 	for _, k := range keys {
-		buf.WriteString(fmt.Sprint(k, ":", mc.data[k], "\n"))
+		buf.WriteString(fmt.Sprint(k, ":", mc.data[k].value, "\n"))
 	}
 
 	return buf.String()
 }
 
 /*
-maintainCache removes expired items and returns the oldest entry.
+expire removes all expired entries. Since all entries in the put order list
+have the same max age the expired entries are at the front of the list.
+Entries with their own TTL are at the top of the TTL heap once they have
+expired. The caller must hold the writer lock.
 */
-func (mc *MapCache) maintainCache() string {
+func (mc *TypedMapCache[K, V]) expire(now time.Time) {
 
-	mc.mutex.RLock()
+	if mc.maxage != 0 {
+		nowSecs := now.Unix()
 
-	oldestTS := int64(math.MaxInt64)
-	oldestK := ""
+		for front := mc.age.Front(); front != nil; front = mc.age.Front() {
+			e := front.Value.(*mapCacheEntry[K, V])
 
-	now := time.Now().Unix()
+			if nowSecs-e.ts <= mc.maxage {
+				break
+			}
 
-	for k, v := range mc.ts {
+			mc.removeEntry(e, EvictionExpired)
+		}
+	}
 
-		// Check if the entry has expired
+	nowNanos := now.UnixNano()
 
-		if mc.maxage != 0 && now-v > mc.maxage {
+	for len(mc.ttls) > 0 && mc.ttls[0].deadline <= nowNanos {
+		mc.removeEntry(mc.ttls[0], EvictionExpired)
+	}
+}
 
-			// Remove entry if it has expired
+/*
+removeEntry removes a given entry. The caller must hold the writer lock.
+*/
+func (mc *TypedMapCache[K, V]) removeEntry(e *mapCacheEntry[K, V], reason EvictionReason) {
+	delete(mc.data, e.key)
 
-			mc.mutex.RUnlock()
-			mc.mutex.Lock()
+	mc.order.Remove(e.order)
 
-			delete(mc.data, k)
-			delete(mc.ts, k)
-			mc.size--
+	if e.age != nil {
+		mc.age.Remove(e.age)
+	}
 
-			mc.mutex.Unlock()
-			mc.mutex.RLock()
-		}
+	if e.ttlIndex != -1 {
+		heap.Remove(&mc.ttls, e.ttlIndex)
+	}
 
-		// Gather oldest entry
+	mc.size--
+	mc.cost -= e.cost
+	mc.evictions[reason]++
 
-		if v < oldestTS {
-			oldestTS = v
-			oldestK = k
-		}
+	if mc.onEvict != nil {
+		e.reason = reason
+		mc.evicted = append(mc.evicted, e)
 	}
+}
+
+/*
+unlock releases the writer lock and reports all entries which were removed
+while the lock was held.
+*/
+func (mc *TypedMapCache[K, V]) unlock() {
+	evicted, onEvict := mc.evicted, mc.onEvict
+	mc.evicted = nil
 
-	mc.mutex.RUnlock()
+	mc.mutex.Unlock()
 
-	return oldestK
+	for _, e := range evicted {
+		onEvict(e.key, e.value, e.reason)
+	}
+}
+
+/*
+mapCacheTTLs is a heap of MapCache entries ordered by their expiry time.
+*/
+type mapCacheTTLs[K comparable, V any] []*mapCacheEntry[K, V]
+
+/*
+Len returns the number of entries in the heap.
+*/
+func (h mapCacheTTLs[K, V]) Len() int {
+	return len(h)
+}
+
+/*
+Less returns if entry i expires before entry j.
+*/
+func (h mapCacheTTLs[K, V]) Less(i, j int) bool {
+	return h[i].deadline < h[j].deadline
+}
+
+/*
+Swap swaps entries i and j.
+*/
+func (h mapCacheTTLs[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ttlIndex = i
+	h[j].ttlIndex = j
+}
+
+/*
+Push adds an entry to the heap.
+*/
+func (h *mapCacheTTLs[K, V]) Push(x interface{}) {
+	e := x.(*mapCacheEntry[K, V])
+	e.ttlIndex = len(*h)
+	*h = append(*h, e)
+}
+
+/*
+Pop removes the last entry from the heap.
+*/
+func (h *mapCacheTTLs[K, V]) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.ttlIndex = -1
+	*h = old[:len(old)-1]
+	return e
 }
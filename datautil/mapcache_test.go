@@ -10,6 +10,7 @@
 package datautil
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -57,8 +58,8 @@ func TestMapCache(t *testing.T) {
 
 	// Simulate different timings
 
-	mc.ts["k1"] = time.Now().Unix() - 6 // Expired
-	mc.ts["k2"] = time.Now().Unix() - 3 // Oldest entry
+	mc.data["k1"].ts = time.Now().Unix() - 6 // Expired
+	mc.data["k2"].ts = time.Now().Unix() - 3 // Oldest entry
 
 	if mc.String() != `
 k1:aaa
@@ -146,3 +147,314 @@ k5:eee
 		return
 	}
 }
+
+func TestMapCacheEvictionPolicies(t *testing.T) {
+
+	fill := func(policy EvictionPolicy) *MapCache {
+		mc := NewMapCacheWithPolicy(3, 0, policy)
+
+		mc.Put("k1", "aaa")
+		mc.Put("k2", "bbb")
+		mc.Put("k3", "ccc")
+
+		mc.Get("k1") // Touch the oldest entry
+
+		mc.Put("k4", "ddd")
+
+		return mc
+	}
+
+	// FIFO removes the entry which was put first
+
+	if mc := fill(EvictFIFO); mc.String() != `
+k2:bbb
+k3:ccc
+k4:ddd
+`[1:] {
+		t.Error("Unexpected cache content:", mc)
+		return
+	}
+
+	// LRU removes the entry which was used least recently
+
+	mc := fill(EvictLRU)
+
+	if mc.String() != `
+k1:aaa
+k3:ccc
+k4:ddd
+`[1:] {
+		t.Error("Unexpected cache content:", mc)
+		return
+	}
+
+	// Updating an entry counts as usage for both policies
+
+	mc.Put("k3", "updateccc")
+	mc.Put("k5", "eee")
+
+	if mc.String() != `
+k3:updateccc
+k4:ddd
+k5:eee
+`[1:] {
+		t.Error("Unexpected cache content:", mc)
+		return
+	}
+
+	// Removed entries are gone from all internal lists
+
+	mc.Remove("k4")
+	mc.Put("k6", "fff")
+	mc.Put("k7", "ggg")
+
+	if mc.String() != `
+k5:eee
+k6:fff
+k7:ggg
+`[1:] || mc.order.Len() != 3 || mc.age.Len() != 3 || mc.Size() != 3 {
+		t.Error("Unexpected cache content:", mc)
+		return
+	}
+
+	// Expired entries are purged from the front of the put order list
+
+	mc = NewMapCacheWithPolicy(0, 5, EvictLRU)
+
+	for i := 0; i < 1000; i++ {
+		mc.Put(fmt.Sprint("k", i), i)
+	}
+
+	for i := 0; i < 500; i++ {
+		mc.data[fmt.Sprint("k", i)].ts = time.Now().Unix() - 6
+	}
+
+	mc.Get("k0")
+
+	if mc.Size() != 500 || len(mc.data) != 500 || mc.age.Len() != 500 {
+		t.Error("Unexpected size:", mc.Size())
+		return
+	}
+}
+
+func TestMapCacheEvictionCallback(t *testing.T) {
+	var evicted []string
+
+	mc := NewMapCache(2, 5)
+
+	mc.SetOnEvict(func(key string, value interface{}, reason EvictionReason) {
+		evicted = append(evicted, fmt.Sprint(key, ":", value, ":", reason))
+
+		// The cache can be used from within the callback
+
+		mc.Size()
+		mc.Get("k0")
+	})
+
+	mc.Put("k1", "aaa")
+	mc.Put("k2", "bbb")
+	mc.Put("k3", "ccc")
+
+	mc.data["k2"].ts = time.Now().Unix() - 6
+
+	mc.Get("k3")
+	mc.Get("k3")
+	mc.Put("k4", "ddd")
+	mc.Remove("k4")
+	mc.Put("k5", "eee")
+	mc.Clear()
+
+	if fmt.Sprint(evicted) != "[k1:aaa:size k2:bbb:expired k4:ddd:removed k3:ccc:cleared k5:eee:cleared]" {
+		t.Error("Unexpected evictions:", evicted)
+		return
+	}
+
+	stats := mc.Stats()
+
+	if fmt.Sprint(stats) != "{2 5 map[expired:1 size:1 removed:1 cleared:2] 0 0}" {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+
+	if res := EvictionReason(5).String(); res != "EvictionReason(5)" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestMapCacheTTL(t *testing.T) {
+	mc := NewMapCache(0, 10)
+
+	mc.Put("k1", "aaa")
+	mc.PutWithTTL("k2", "bbb", time.Hour)
+	mc.PutWithTTL("k3", "ccc", 0)
+	mc.PutWithTTL("k4", "ddd", time.Hour)
+
+	// Entries with their own TTL ignore the max age of the cache
+
+	mc.data["k1"].ts = time.Now().Unix() - 11
+	mc.data["k3"].ts = time.Now().Unix() - 11
+
+	mc.GetAll()
+
+	if res := mc.String(); res != `
+k2:bbb
+k3:ccc
+k4:ddd
+`[1:] {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Expire entries with their own TTL
+
+	mc.data["k4"].deadline = time.Now().UnixNano() - 1
+	mc.PutWithTTL("k2", "bbb2", time.Hour)
+
+	if _, ok := mc.Get("k4"); ok || mc.Size() != 2 || len(mc.ttls) != 1 {
+		t.Error("Unexpected result:", mc.Size(), len(mc.ttls))
+		return
+	}
+
+	// Putting an entry without TTL uses the max age again
+
+	mc.Put("k2", "bbb3")
+
+	if len(mc.ttls) != 0 || mc.age.Len() != 1 {
+		t.Error("Unexpected result:", len(mc.ttls), mc.age.Len())
+		return
+	}
+
+	mc.data["k2"].ts = time.Now().Unix() - 11
+
+	mc.GetAll()
+
+	if res := mc.String(); res != "k3:ccc\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A short TTL expires
+
+	mc.PutWithTTL("k5", "eee", time.Millisecond)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := mc.Get("k5"); ok {
+		t.Error("Entry should have expired")
+		return
+	}
+}
+
+func TestMapCacheCost(t *testing.T) {
+	var evicted []string
+
+	mc := NewMapCache(10, 0)
+
+	mc.SetOnEvict(func(key string, value interface{}, reason EvictionReason) {
+		evicted = append(evicted, fmt.Sprint(key, ":", reason))
+	})
+
+	mc.Put("k1", "aaa")
+	mc.Put("k2", "bbbb")
+	mc.Put("k3", "cc")
+
+	if mc.Cost() != 3 {
+		t.Error("Unexpected result:", mc.Cost())
+		return
+	}
+
+	mc.SetCostFunc(func(key string, value interface{}) uint64 {
+		return uint64(len(value.(string)))
+	})
+
+	if mc.Cost() != 9 || mc.Size() != 3 {
+		t.Error("Unexpected result:", mc.Cost(), mc.Size())
+		return
+	}
+
+	// Eviction continues until the budget is met
+
+	mc.Put("k4", "dddddd")
+
+	if res := mc.String(); res != "k3:cc\nk4:dddddd\n" || mc.Cost() != 8 {
+		t.Error("Unexpected result:", res, mc.Cost())
+		return
+	}
+
+	// Updates change the cost
+
+	mc.Put("k3", "c")
+
+	if mc.Cost() != 7 || mc.Stats().Cost != 7 {
+		t.Error("Unexpected result:", mc.Cost())
+		return
+	}
+
+	// An entry which exceeds the whole budget is not kept
+
+	mc.Put("k5", "eeeeeeeeeee")
+
+	if mc.Size() != 0 || mc.Cost() != 0 {
+		t.Error("Unexpected result:", mc.Size(), mc.Cost())
+		return
+	}
+
+	if fmt.Sprint(evicted) != "[k1:size k2:size k4:size k3:size k5:size]" {
+		t.Error("Unexpected evictions:", evicted)
+		return
+	}
+
+	// Lowering the budget by setting a new cost function evicts entries
+
+	mc.Put("k6", "ff")
+	mc.Put("k7", "gg")
+
+	mc.SetCostFunc(func(key string, value interface{}) uint64 {
+		return 6
+	})
+
+	if res := mc.String(); res != "k7:gg\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestTypedMapCache(t *testing.T) {
+	var evicted []int
+
+	mc := NewTypedMapCache[int, string](2, 0)
+
+	mc.SetOnEvict(func(key int, value string, reason EvictionReason) {
+		evicted = append(evicted, key)
+	})
+
+	mc.Put(10, "aaa")
+	mc.Put(2, "bbb")
+	mc.Put(1, "ccc")
+
+	if v, ok := mc.Get(10); ok || v != "" {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	if v, ok := mc.Get(2); !ok || v+"!" != "bbb!" {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	if res := mc.String(); res != "1:ccc\n2:bbb\n" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := mc.GetAll(); len(res) != 2 || res[1] != "ccc" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if fmt.Sprint(evicted) != "[10]" {
+		t.Error("Unexpected evictions:", evicted)
+		return
+	}
+}
@@ -35,6 +35,44 @@ nonces is an internal map which holds all valid nonces
 */
 var nonces *MapCache
 
+/*
+nonceEvictHandler is called for every nonce which is removed from the nonces map
+*/
+var nonceEvictHandler func(nonce string, reason EvictionReason)
+
+/*
+SetNonceEvictHandler sets a handler which is called for every nonce which is
+no longer valid. The reason is EvictionRemoved for consumed nonces and
+EvictionExpired for nonces which have timed out.
+*/
+func SetNonceEvictHandler(handler func(nonce string, reason EvictionReason)) {
+	nonceEvictHandler = handler
+
+	if nonces != nil {
+		nonces.SetOnEvict(onNonceEvict)
+	}
+}
+
+/*
+NonceStats returns statistics of the nonce store.
+*/
+func NonceStats() MapCacheStats {
+	if nonces == nil {
+		return MapCacheStats{Evictions: make(map[EvictionReason]uint64)}
+	}
+
+	return nonces.Stats()
+}
+
+/*
+onNonceEvict is the eviction callback of the nonces map.
+*/
+func onNonceEvict(key string, value interface{}, reason EvictionReason) {
+	if handler := nonceEvictHandler; handler != nil {
+		handler(key, reason)
+	}
+}
+
 /*
 NewNonce generates a new nonce value. The nonce is invalidated either
 after it was consumed or automatically after MaxNonceLifetime seconds.
@@ -46,6 +84,7 @@ func NewNonce() string {
 		// Create nonce cache if it doesn't exist yet
 
 		nonces = NewMapCache(0, MaxNonceLifetime)
+		nonces.SetOnEvict(onNonceEvict)
 	}
 
 	// Get a timestamp
@@ -10,6 +10,7 @@
 package datautil
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -53,3 +54,45 @@ func TestNonces(t *testing.T) {
 		return
 	}
 }
+
+func TestNonceStats(t *testing.T) {
+	nonces = nil
+
+	if stats := NonceStats(); stats.Size != 0 || stats.Hits != 0 {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+
+	var evicted []string
+
+	SetNonceEvictHandler(func(nonce string, reason EvictionReason) {
+		evicted = append(evicted, reason.String())
+	})
+	defer SetNonceEvictHandler(nil)
+
+	n1 := NewNonce()
+	n2 := NewNonce()
+
+	CheckNonce(n1)
+	ConsumeNonce(n1)
+	CheckNonce(n1)
+
+	// Simulate timeout
+
+	nonces.data[n2].ts -= MaxNonceLifetime + 1
+
+	CheckNonce(n2)
+
+	if fmt.Sprint(evicted) != "[removed expired]" {
+		t.Error("Unexpected evictions:", evicted)
+		return
+	}
+
+	stats := NonceStats()
+
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Size != 0 ||
+		stats.Evictions[EvictionRemoved] != 1 || stats.Evictions[EvictionExpired] != 1 {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+}
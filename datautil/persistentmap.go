@@ -10,103 +10,426 @@
 package datautil
 
 import (
-	"encoding/gob"
+	"io"
+	"maps"
 	"os"
+	"path/filepath"
 )
 
+/*
+BackupSuffix is the suffix of the backup file of a persistent map.
+*/
+const BackupSuffix = ".bak"
+
+/*
+PersistentMapOptions are options for persistent maps.
+*/
+type PersistentMapOptions struct {
+	Backup       bool  // Keep the previous generation of the file as backup
+	WAL          bool  // Append changes made with Put and Delete to a log file instead of rewriting the whole file (PersistentMap only)
+	CompactAfter int   // Number of log records after which the log is compacted into the file (default is 1000)
+	Codec        Codec // Codec for writing the file (default is gob without header)
+}
+
 /*
 PersistentMap is a persistent map storing string values. This implementation returns
 more encoding / decoding errors since not all possible values are supported.
 */
-type PersistentMap struct {
-	filename string                 // File of the persistent map
-	Data     map[string]interface{} // Data of the persistent map
+type PersistentMap = TypedPersistentMap[interface{}]
+
+/*
+TypedPersistentMap is a persistent map storing values of a given type. Unlike
+PersistentMap the values keep their type when they are loaded with the JSON
+codec.
+*/
+type TypedPersistentMap[V any] struct {
+	filename string               // File of the persistent map
+	Data     map[string]V         // Data of the persistent map
+	options  PersistentMapOptions // Options of the persistent map
+	wal      *walLog[V]           // Write-ahead log (if enabled)
 }
 
 /*
 NewPersistentMap creates a new persistent map.
 */
 func NewPersistentMap(filename string) (*PersistentMap, error) {
-	pm := &PersistentMap{filename, make(map[string]interface{})}
+	return NewPersistentMapWithOptions(filename, PersistentMapOptions{})
+}
+
+/*
+NewPersistentMapWithOptions creates a new persistent map with the given options.
+*/
+func NewPersistentMapWithOptions(filename string, options PersistentMapOptions) (*PersistentMap, error) {
+	return NewTypedPersistentMap[interface{}](filename, options)
+}
+
+/*
+NewTypedPersistentMap creates a new typed persistent map with the given options.
+*/
+func NewTypedPersistentMap[V any](filename string, options PersistentMapOptions) (*TypedPersistentMap[V], error) {
+	pm := &TypedPersistentMap[V]{filename, make(map[string]V), options, nil}
+
+	if options.WAL {
+		var err error
+
+		if pm.wal, err = newWalLog[V](filename, options.Codec); err != nil {
+			return nil, err
+		}
+
+		return pm, pm.Compact()
+	}
+
 	return pm, pm.Flush()
 }
 
 /*
-LoadPersistentMap loads a persistent map from a file.
+LoadPersistentMap loads a persistent map from a file. The backup file is
+loaded instead if the file cannot be decoded.
 */
 func LoadPersistentMap(filename string) (*PersistentMap, error) {
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0660)
-	if err != nil {
-		return nil, err
+	return LoadPersistentMapWithOptions(filename, PersistentMapOptions{})
+}
+
+/*
+LoadPersistentMapWithOptions loads a persistent map from a file. The given options
+are used for all further operations on the map.
+*/
+func LoadPersistentMapWithOptions(filename string, options PersistentMapOptions) (*PersistentMap, error) {
+	return LoadTypedPersistentMap[interface{}](filename, options)
+}
+
+/*
+LoadTypedPersistentMap loads a typed persistent map from a file. The backup
+file is loaded instead if the file cannot be decoded. The write-ahead log
+belongs to the newer file so it is emptied and not replayed if the backup is
+loaded. The given options are used for all further operations on the map.
+*/
+func LoadTypedPersistentMap[V any](filename string, options PersistentMapOptions) (*TypedPersistentMap[V], error) {
+	var err error
+
+	pm := &TypedPersistentMap[V]{filename, make(map[string]V), options, nil}
+
+	if options.WAL {
+		if pm.wal, err = newWalLog[V](filename, options.Codec); err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	pm := &PersistentMap{filename, make(map[string]interface{})}
+	err = decodeMapFile(filename, true, options.Codec, &pm.Data)
+
+	if err == nil && pm.wal != nil {
+		err = pm.wal.replay(pm.Data)
 
-	de := gob.NewDecoder(file)
+	} else if err != nil {
+		backup := make(map[string]V)
 
-	return pm, de.Decode(&pm.Data)
+		if decodeMapFile(filename+BackupSuffix, false, options.Codec, &backup) == nil {
+			pm.Data = backup
+			err = nil
+
+			if pm.wal != nil {
+				err = pm.wal.clear()
+			}
+		}
+	}
+
+	return pm, err
 }
 
 /*
-Flush writes contents of the persistent map to the disk.
+Put stores a value in the map. The change is written by the next flush.
+*/
+func (pm *TypedPersistentMap[V]) Put(key string, value V) {
+	pm.Data[key] = value
+	pm.Changed(key)
+}
+
+/*
+Delete removes a value from the map. The change is written by the next flush.
+*/
+func (pm *TypedPersistentMap[V]) Delete(key string) {
+	delete(pm.Data, key)
+	pm.Changed(key)
+}
+
+/*
+Changed reports keys whose values were changed directly in the Data map (e.g.
+values which were modified in place). If the write-ahead log is enabled only
+changes which were made with Put and Delete or reported with Changed are
+written by Flush - all other changes are only written by Compact.
+*/
+func (pm *TypedPersistentMap[V]) Changed(keys ...string) {
+	if pm.wal != nil {
+		for _, k := range keys {
+			pm.wal.changed[k] = struct{}{}
+		}
+	}
+}
+
+/*
+Flush writes contents of the persistent map to the disk. If the write-ahead
+log is enabled only the changes since the last flush are appended to the log
+(see Changed).
+*/
+func (pm *TypedPersistentMap[V]) Flush() error {
+	return pm.prepareFlush(false).run()
+}
+
+/*
+Compact writes the contents of the persistent map to the disk and empties
+the write-ahead log (if enabled).
+*/
+func (pm *TypedPersistentMap[V]) Compact() error {
+	return pm.prepareFlush(true).run()
+}
+
+/*
+mapFlush is a flush of a persistent map which works on a snapshot of the
+changes. The snapshot is taken while the map is locked and can be written
+without holding the lock.
+*/
+type mapFlush[V any] struct {
+	pm      *TypedPersistentMap[V] // Flushed persistent map
+	data    map[string]V           // Copy of the data if the whole map is written
+	records []walRecord[V]         // Changes which are appended to the write-ahead log
+}
+
+/*
+prepareFlush takes a snapshot of the changes which are written by a flush.
+The whole map is written if the write-ahead log is disabled, if compact is
+set or if the log has grown too large.
+*/
+func (pm *TypedPersistentMap[V]) prepareFlush(compact bool) *mapFlush[V] {
+	mf := &mapFlush[V]{pm, nil, nil}
+
+	if pm.wal == nil {
+		mf.data = maps.Clone(pm.Data)
+		return mf
+	}
+
+	for k := range pm.wal.changed {
+		record := walRecord[V]{Delete: true, Key: k}
+
+		if v, ok := pm.Data[k]; ok {
+			record = walRecord[V]{false, k, v}
+		}
+
+		mf.records = append(mf.records, record)
+	}
+
+	pm.wal.changed = make(map[string]struct{})
+
+	compactAfter := pm.options.CompactAfter
+
+	if compactAfter <= 0 {
+		compactAfter = DefaultCompactAfter
+	}
+
+	if compact || pm.wal.records+len(mf.records) >= compactAfter {
+		mf.data = maps.Clone(pm.Data)
+	}
+
+	return mf
+}
+
+/*
+run writes the snapshot and restores the changes of the snapshot if the
+write failed. This function is used if there is no lock to release.
 */
-func (pm *PersistentMap) Flush() error {
-	file, err := os.OpenFile(pm.filename, os.O_CREATE|os.O_RDWR, 0660)
+func (mf *mapFlush[V]) run() error {
+	err := mf.write()
+
 	if err != nil {
-		return err
+		mf.restore()
 	}
-	defer file.Close()
 
-	en := gob.NewEncoder(file)
+	return err
+}
+
+/*
+write writes the snapshot to the disk. When the map is compacted all changes
+are appended to the log before the map file is written. Replaying the old log
+on top of the new file gives the same data so a crash before the log was
+emptied does no harm.
+*/
+func (mf *mapFlush[V]) write() error {
+	pm := mf.pm
+
+	if pm.wal == nil {
+		return writeMapFile(pm.filename, pm.options.Backup, pm.options.Codec, mf.data)
+	}
+
+	err := pm.wal.write(mf.records)
+
+	if err == nil && mf.data != nil {
+		if err = writeMapFile(pm.filename, pm.options.Backup, pm.options.Codec, mf.data); err == nil {
+			err = pm.wal.truncate()
+		}
+	}
+
+	if err == nil {
+		mf.records = nil
+	}
 
-	return en.Encode(pm.Data)
+	return err
+}
+
+/*
+restore marks the changes of a failed flush as changed again so they are
+written by the next flush.
+*/
+func (mf *mapFlush[V]) restore() {
+	for _, record := range mf.records {
+		mf.pm.Changed(record.Key)
+	}
 }
 
 /*
 PersistentStringMap is a persistent map storing string values.
 */
 type PersistentStringMap struct {
-	filename string            // File of the persistent map
-	Data     map[string]string // Data of the persistent map
+	filename string               // File of the persistent map
+	Data     map[string]string    // Data of the persistent map
+	options  PersistentMapOptions // Options of the persistent map
 }
 
 /*
 NewPersistentStringMap creates a new persistent map.
 */
 func NewPersistentStringMap(filename string) (*PersistentStringMap, error) {
-	pm := &PersistentStringMap{filename, make(map[string]string)}
+	return NewPersistentStringMapWithOptions(filename, PersistentMapOptions{})
+}
+
+/*
+NewPersistentStringMapWithOptions creates a new persistent map with the given options.
+*/
+func NewPersistentStringMapWithOptions(filename string, options PersistentMapOptions) (*PersistentStringMap, error) {
+	pm := &PersistentStringMap{filename, make(map[string]string), options}
 	return pm, pm.Flush()
 }
 
 /*
-LoadPersistentStringMap loads a persistent map from a file.
+LoadPersistentStringMap loads a persistent map from a file. The backup file is
+loaded instead if the file cannot be decoded.
 */
 func LoadPersistentStringMap(filename string) (*PersistentStringMap, error) {
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0660)
-	if err != nil {
+	return LoadPersistentStringMapWithOptions(filename, PersistentMapOptions{})
+}
+
+/*
+LoadPersistentStringMapWithOptions loads a persistent map from a file. The given
+options are used for all further operations on the map. Decoding errors are only
+reported if the options contain a codec. An empty file is only accepted if the
+codec is not secure (e.g. not encrypted).
+*/
+func LoadPersistentStringMapWithOptions(filename string, options PersistentMapOptions) (*PersistentStringMap, error) {
+	pm := &PersistentStringMap{filename, make(map[string]string), options}
+
+	err := decodeMapFile(filename, true, options.Codec, &pm.Data)
+
+	if _, ok := err.(*os.PathError); ok {
 		return nil, err
-	}
 
-	pm := &PersistentStringMap{filename, make(map[string]string)}
+	} else if err != nil {
+		backup := make(map[string]string)
+
+		if decodeMapFile(filename+BackupSuffix, false, options.Codec, &backup) == nil {
+			pm.Data = backup
+
+		} else if _, secure := options.Codec.(secureCodec); secure ||
+			(options.Codec != nil && err != io.EOF) {
 
-	de := gob.NewDecoder(file)
-	de.Decode(&pm.Data)
+			// Only report errors if a codec was given explicitly - plain
+			// gob files were always loaded without reporting errors
 
-	return pm, file.Close()
+			return nil, err
+		}
+	}
+
+	return pm, nil
 }
 
 /*
 Flush writes contents of the persistent map to the disk.
 */
 func (pm *PersistentStringMap) Flush() error {
-	file, err := os.OpenFile(pm.filename, os.O_CREATE|os.O_RDWR, 0660)
+	return writeMapFile(pm.filename, pm.options.Backup, pm.options.Codec, pm.Data)
+}
+
+/*
+decodeMapFile decodes the contents of a given file. The file is created if
+it does not exist and the create flag is set.
+*/
+func decodeMapFile(filename string, create bool, codec Codec, data interface{}) error {
+	flags := os.O_RDONLY
+
+	if create {
+		flags = os.O_CREATE | os.O_RDWR
+	}
+
+	file, err := os.OpenFile(filename, flags, 0660)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return decodeMap(file, codec, data)
+}
+
+/*
+writeMapFile writes the given data to a file. The data is written to a
+temporary file which is synced to disk and then renamed to the given file.
+The file is either replaced completely or not at all. The previous file is
+kept as backup if the backup flag is set.
+*/
+func writeMapFile(filename string, backup bool, codec Codec, data interface{}) error {
+	dir, base := filepath.Split(filename)
+
+	if dir == "" {
+		dir = "."
+	}
+
+	file, err := os.CreateTemp(dir, base+".*.tmp")
 	if err != nil {
 		return err
 	}
 
-	en := gob.NewEncoder(file)
-	en.Encode(pm.Data)
+	tmpname := file.Name()
+
+	if err = encodeMap(file, codec, data); err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmpname, 0660)
+	}
+
+	if err == nil && backup {
+		if _, serr := os.Stat(filename); serr == nil {
+			err = os.Rename(filename, filename+BackupSuffix)
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// Make sure the rename itself is on disk - not all platforms support
+	// syncing a directory so errors are ignored
+
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
 
-	return file.Close()
+	return nil
 }
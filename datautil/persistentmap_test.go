@@ -10,11 +10,16 @@
 package datautil
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/rhedin/Abe_common/cryptutil"
 	"github.com/rhedin/Abe_common/fileutil"
 )
 
@@ -36,6 +41,9 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	// Keep password hashing fast
+	PBKDF2Iterations = 1000
+
 	// Run the tests
 	res := m.Run()
 
@@ -90,7 +98,7 @@ func TestPersistentMap(t *testing.T) {
 		return
 	}
 
-	pm = &PersistentMap{invalidFileName, make(map[string]interface{})}
+	pm = &PersistentMap{invalidFileName, make(map[string]interface{}), PersistentMapOptions{}, nil}
 	if err := pm.Flush(); err == nil {
 		t.Error("Unexpected result of new map")
 		return
@@ -138,9 +146,724 @@ func TestPersistentStringMap(t *testing.T) {
 		return
 	}
 
-	pm = &PersistentStringMap{invalidFileName, make(map[string]string)}
+	pm = &PersistentStringMap{invalidFileName, make(map[string]string), PersistentMapOptions{}}
 	if err := pm.Flush(); err == nil {
 		t.Error("Unexpected result of new map")
 		return
 	}
 }
+
+func TestPersistentMapAtomicFlush(t *testing.T) {
+	filename := testdbdir + "/testatomicmap.map"
+
+	pm, err := NewPersistentMapWithOptions(filename, PersistentMapOptions{Backup: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		pm.Data[fmt.Sprint("test", i)] = fmt.Sprint("test", i, "data")
+	}
+
+	pm.Flush()
+
+	// Shrinking the map must not leave old data in the file
+
+	pm.Data = map[string]interface{}{"test1": "test1data"}
+
+	pm.Flush()
+
+	pm2, err := LoadPersistentMap(filename)
+	if err != nil || len(pm2.Data) != 1 || pm2.Data["test1"] != "test1data" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// The previous generation was kept as backup
+
+	if err := os.WriteFile(filename, []byte("garbage"), 0660); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm2, err = LoadPersistentMap(filename)
+	if err != nil || len(pm2.Data) != 100 || pm2.Data["test99"] != "test99data" {
+		t.Error("Unexpected data in map:", len(pm2.Data), err)
+		return
+	}
+
+	// No temporary files are left behind
+
+	if files, _ := filepath.Glob(filename + ".*.tmp"); len(files) != 0 {
+		t.Error("Unexpected temporary files:", files)
+		return
+	}
+
+	// Without a backup a broken file cannot be loaded
+
+	os.Remove(filename + BackupSuffix)
+
+	if _, err = LoadPersistentMap(filename); err == nil {
+		t.Error("Loading a broken file should fail")
+		return
+	}
+
+	// String maps work the same way
+
+	filename = testdbdir + "/testatomicstringmap.map"
+
+	psm, err := NewPersistentStringMapWithOptions(filename, PersistentMapOptions{Backup: true})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	psm.Data["test1"] = "test1data"
+	psm.Data["test2"] = "test2data"
+
+	psm.Flush()
+
+	delete(psm.Data, "test2")
+
+	psm.Flush()
+
+	psm2, _ := LoadPersistentStringMap(filename)
+
+	if len(psm2.Data) != 1 || psm2.Data["test1"] != "test1data" {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+
+	os.WriteFile(filename, []byte("garbage"), 0660)
+
+	psm2, _ = LoadPersistentStringMap(filename)
+
+	if len(psm2.Data) != 2 || psm2.Data["test2"] != "test2data" {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+}
+
+func TestPersistentMapWAL(t *testing.T) {
+	filename := testdbdir + "/testwalmap.map"
+	options := PersistentMapOptions{WAL: true, CompactAfter: 10}
+
+	pm, err := NewPersistentMapWithOptions(filename, options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm.Put("test1", "test1data")
+	pm.Put("test2", "test2data")
+	pm.Put("test3", "test3data")
+
+	if err := pm.Flush(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm.Delete("test2")
+	pm.Put("test3", "test3newdata")
+
+	pm.Flush()
+
+	// Only the changes are written to the log
+
+	if pm.wal.records != 5 {
+		t.Error("Unexpected number of records:", pm.wal.records)
+		return
+	}
+
+	pm2, err := LoadPersistentMapWithOptions(filename, options)
+	if err != nil || len(pm2.Data) != 2 || pm2.Data["test3"] != "test3newdata" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// The map file itself was not touched
+
+	pm3, _ := LoadPersistentMap(filename)
+
+	if len(pm3.Data) != 0 {
+		t.Error("Unexpected data in map:", pm3.Data)
+		return
+	}
+
+	// A partly written record is discarded
+
+	file, _ := os.OpenFile(filename+WALSuffix, os.O_APPEND|os.O_WRONLY, 0660)
+	file.Write([]byte{0, 0, 1, 0, 1, 2})
+	file.Close()
+
+	pm2, err = LoadPersistentMapWithOptions(filename, options)
+	if err != nil || len(pm2.Data) != 2 || pm2.wal.records != 5 {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	pm2.Put("test4", "test4data")
+	pm2.Flush()
+
+	pm2, err = LoadPersistentMapWithOptions(filename, options)
+	if err != nil || len(pm2.Data) != 3 || pm2.wal.records != 6 {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// The log is compacted once it has grown too large
+
+	for i := 0; i < 5; i++ {
+		pm2.Put(fmt.Sprint("key", i), i)
+	}
+
+	pm2.Flush()
+
+	if pm2.wal.records != 0 {
+		t.Error("Unexpected number of records:", pm2.wal.records)
+		return
+	}
+
+	if stat, _ := os.Stat(filename + WALSuffix); stat.Size() != 0 {
+		t.Error("Unexpected log size:", stat.Size())
+		return
+	}
+
+	pm3, _ = LoadPersistentMap(filename)
+
+	if len(pm3.Data) != 8 || pm3.Data["key4"] != 4 {
+		t.Error("Unexpected data in map:", pm3.Data)
+		return
+	}
+
+	// A new map starts with an empty log
+
+	pm, _ = NewPersistentMapWithOptions(filename, options)
+	pm2, _ = LoadPersistentMapWithOptions(filename, options)
+
+	if len(pm.Data) != 0 || len(pm2.Data) != 0 {
+		t.Error("Unexpected data in map:", pm2.Data)
+		return
+	}
+
+	if _, err := LoadPersistentMapWithOptions(invalidFileName, options); err == nil {
+		t.Error("Unexpected result of new map")
+		return
+	}
+}
+
+func TestPersistentMapWALInPlace(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "testwalinplacemap.map")
+	options := PersistentMapOptions{WAL: true, Backup: true}
+
+	pm, err := NewTypedPersistentMap[map[string]string](filename, options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm.Put("test1", map[string]string{"a": "1", "b": "2", "c": "3"})
+	pm.Flush()
+
+	// Values which were changed in place are logged once they are reported
+
+	pm.Data["test1"]["a"] = "4"
+	pm.Changed("test1")
+	pm.Flush()
+
+	if pm.wal.records != 2 {
+		t.Error("Unexpected number of records:", pm.wal.records)
+		return
+	}
+
+	// Unchanged values are not logged again
+
+	pm.Flush()
+
+	if pm.wal.records != 2 {
+		t.Error("Unexpected number of records:", pm.wal.records)
+		return
+	}
+
+	pm2, err := LoadTypedPersistentMap[map[string]string](filename, options)
+	if err != nil || pm2.Data["test1"]["a"] != "4" || len(pm2.Data["test1"]) != 3 {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// Changes after loading are logged as well
+
+	pm2.Data["test1"]["b"] = "5"
+	pm2.Changed("test1")
+	pm2.Flush()
+
+	pm3, err := LoadTypedPersistentMap[map[string]string](filename, options)
+	if err != nil || pm3.Data["test1"]["a"] != "4" || pm3.Data["test1"]["b"] != "5" ||
+		pm3.wal.records != 3 {
+		t.Error("Unexpected data in map:", pm3.Data, err)
+		return
+	}
+
+	// The log is not replayed on top of the backup
+
+	pm3.Compact()
+	pm3.Put("test2", map[string]string{"d": "6"})
+	pm3.Compact()
+	pm3.Delete("test1")
+	pm3.Flush()
+
+	os.WriteFile(filename, []byte("garbage"), 0660)
+
+	pm4, err := LoadTypedPersistentMap[map[string]string](filename, options)
+	if err != nil || len(pm4.Data) != 1 || pm4.Data["test1"]["b"] != "5" || pm4.wal.records != 0 {
+		t.Error("Unexpected data in map:", pm4.Data, err)
+		return
+	}
+
+	if stat, _ := os.Stat(filename + WALSuffix); stat.Size() != 0 {
+		t.Error("Unexpected log size:", stat.Size())
+		return
+	}
+}
+
+/*
+upperCodec is a custom codec which stores the JSON encoding in upper case.
+*/
+type upperCodec struct {
+}
+
+func (c *upperCodec) Name() string {
+	return "upper"
+}
+
+func (c *upperCodec) Encode(w io.Writer, data interface{}) error {
+	var buf bytes.Buffer
+
+	if err := JSONCodec.Encode(&buf, data); err != nil {
+		return err
+	}
+
+	_, err := w.Write(bytes.ToUpper(buf.Bytes()))
+
+	return err
+}
+
+func (c *upperCodec) Decode(r io.Reader, data interface{}) error {
+	return JSONCodec.Decode(r, data)
+}
+
+func TestPersistentMapCodecs(t *testing.T) {
+	filename := testdbdir + "/testcodecmap.map"
+
+	pm, err := NewPersistentMapWithOptions(filename, PersistentMapOptions{Codec: JSONCodec})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm.Data["test1"] = "test1data"
+	pm.Data["test2"] = 5
+
+	pm.Flush()
+
+	content, _ := os.ReadFile(filename)
+
+	if string(content) != `#persistentmap:json
+{
+  "test1": "test1data",
+  "test2": 5
+}
+` {
+		t.Error("Unexpected file content:", string(content))
+		return
+	}
+
+	// The codec is detected when loading
+
+	pm2, err := LoadPersistentMap(filename)
+	if err != nil || pm2.Data["test1"] != "test1data" || pm2.Data["test2"] != float64(5) {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// Convert to gob and back
+
+	if err := ConvertPersistentMap(filename, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if content, _ := os.ReadFile(filename); bytes.HasPrefix(content, []byte(codecHeader)) {
+		t.Error("Unexpected file content:", string(content))
+		return
+	}
+
+	pm2, err = LoadPersistentMap(filename)
+	if err != nil || pm2.Data["test1"] != "test1data" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	if err := ConvertPersistentMap(filename, GobCodec); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if content, _ := os.ReadFile(filename); !bytes.HasPrefix(content, []byte(codecHeader+"gob\n")) {
+		t.Error("Unexpected file content:", string(content))
+		return
+	}
+
+	if err := ConvertPersistentMap(filename, JSONCodec); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm2, err = LoadPersistentMap(filename)
+	if err != nil || pm2.Data["test1"] != "test1data" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// Values which are not strings survive a round trip through JSON as
+	// generic JSON types
+
+	filename = filepath.Join(t.TempDir(), "testcodecroundtrip.map")
+
+	pm, _ = NewPersistentMapWithOptions(filename, PersistentMapOptions{Codec: JSONCodec})
+	pm.Data["list"] = []string{"x", "y"}
+	pm.Data["num"] = 5
+	pm.Data["map"] = map[string]bool{"a": true}
+	pm.Flush()
+
+	if err := ConvertPersistentMap(filename, GobCodec); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ConvertPersistentMap(filename, JSONCodec); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ConvertPersistentMap(filename, nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm2, err = LoadPersistentMap(filename)
+	if err != nil || !reflect.DeepEqual(pm2.Data, map[string]interface{}{
+		"list": []interface{}{"x", "y"},
+		"num":  float64(5),
+		"map":  map[string]interface{}{"a": true},
+	}) {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// String maps
+
+	filename = testdbdir + "/testcodecstringmap.map"
+
+	psm, _ := NewPersistentStringMap(filename)
+	psm.Data["test1"] = "test1data"
+	psm.Flush()
+
+	if err := ConvertPersistentStringMap(filename, JSONCodec); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if content, _ := os.ReadFile(filename); !bytes.HasPrefix(content, []byte(codecHeader+"json\n")) {
+		t.Error("Unexpected file content:", string(content))
+		return
+	}
+
+	psm2, _ := LoadPersistentStringMap(filename)
+
+	if psm2.Data["test1"] != "test1data" {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+
+	// Custom codecs must be registered unless they are given as option
+
+	psm2.options.Codec = &upperCodec{}
+	psm2.Flush()
+
+	if psm2, _ = LoadPersistentStringMap(filename); len(psm2.Data) != 0 {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+
+	if _, err = LoadPersistentMap(filename); err == nil || err.Error() != "Unknown codec: upper" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	psm2, _ = LoadPersistentStringMapWithOptions(filename, PersistentMapOptions{Codec: &upperCodec{}})
+
+	if psm2.Data["TEST1"] != "TEST1DATA" {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+
+	RegisterCodec(&upperCodec{})
+	defer func() {
+		delete(codecs, "upper")
+	}()
+
+	if psm2, _ = LoadPersistentStringMap(filename); psm2.Data["TEST1"] != "TEST1DATA" {
+		t.Error("Unexpected data in map:", psm2.Data)
+		return
+	}
+
+	// Test error cases
+
+	if err := ConvertPersistentMap(testdbdir+"/nonexisting.map", JSONCodec); err == nil {
+		t.Error("Unexpected result")
+		return
+	}
+
+	if err := ConvertPersistentStringMap(testdbdir+"/nonexisting.map", JSONCodec); err == nil {
+		t.Error("Unexpected result")
+		return
+	}
+
+	os.WriteFile(filename, []byte(codecHeader+"json"), 0660)
+
+	if _, err = LoadPersistentMap(filename); err == nil || err.Error() != "Invalid codec header: EOF" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestEncryptedPersistentMap(t *testing.T) {
+	dir := t.TempDir()
+
+	filename := filepath.Join(dir, "testencryptedmap.map")
+
+	pm, err := NewEncryptedPersistentMap(filename, "foo")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pm.Data["token"] = "secrettoken"
+	pm.Flush()
+
+	if content, _ := os.ReadFile(filename); bytes.Contains(content, []byte("secrettoken")) {
+		t.Error("Unexpected file content:", string(content))
+		return
+	}
+
+	pm2, err := LoadEncryptedPersistentMap(filename, "foo")
+	if err != nil || pm2.Data["token"] != "secrettoken" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	if _, err = LoadEncryptedPersistentMap(filename, "bar"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = LoadPersistentMap(filename); err == nil || err.Error() != "Unknown codec: encrypted" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Tampering is detected
+
+	content, _ := os.ReadFile(filename)
+	content[len(content)-40] ^= 1
+	os.WriteFile(filename, content, 0660)
+
+	if _, err = LoadEncryptedPersistentMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// String maps
+
+	filename = filepath.Join(dir, "testencryptedstringmap.map")
+
+	// A missing or empty file cannot be loaded - it could have been truncated
+
+	if _, err := LoadEncryptedPersistentStringMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	psm, err := NewEncryptedPersistentStringMap(filename, "foo")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	psm.Data["token"] = "secrettoken"
+	psm.Flush()
+
+	psm2, err := LoadEncryptedPersistentStringMap(filename, "foo")
+	if err != nil || psm2.Data["token"] != "secrettoken" {
+		t.Error("Unexpected data in map:", psm2.Data, err)
+		return
+	}
+
+	if _, err = LoadEncryptedPersistentStringMap(filename, "bar"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	content, _ = os.ReadFile(filename)
+	os.WriteFile(filename, nil, 0660)
+
+	if _, err = LoadEncryptedPersistentStringMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = LoadEncryptedPersistentMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	os.WriteFile(filename, content[:len(content)/2], 0660)
+
+	if _, err = LoadEncryptedPersistentStringMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Encrypted JSON
+
+	pm, _ = NewPersistentMapWithOptions(filepath.Join(dir, "testencryptedjsonmap.map"),
+		PersistentMapOptions{Codec: EncryptedCodec("foo", JSONCodec)})
+
+	pm.Data["token"] = "secrettoken"
+	pm.Flush()
+
+	pm2, err = LoadEncryptedPersistentMap(filepath.Join(dir, "testencryptedjsonmap.map"), "foo")
+	if err != nil || pm2.Data["token"] != "secrettoken" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// Substituted plaintext files are rejected
+
+	for _, codec := range []Codec{nil, GobCodec, JSONCodec} {
+		plain, _ := NewPersistentMapWithOptions(filename, PersistentMapOptions{Codec: codec})
+		plain.Data["token"] = "substitutedtoken"
+		plain.Flush()
+
+		if _, err = LoadEncryptedPersistentMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+			t.Error("Unexpected result:", codec, err)
+			return
+		}
+
+		if _, err = LoadEncryptedPersistentStringMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+			t.Error("Unexpected result:", codec, err)
+			return
+		}
+	}
+
+	// Also if the substituted file is the backup
+
+	os.WriteFile(filename, []byte("garbage"), 0660)
+
+	plain, _ := NewPersistentMap(filename + BackupSuffix)
+	plain.Data["token"] = "substitutedtoken"
+	plain.Flush()
+
+	if _, err = LoadEncryptedPersistentMap(filename, "foo"); err != cryptutil.ErrAuthentication {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Plaintext files can still be converted
+
+	if err := ConvertPersistentMap(filename+BackupSuffix, EncryptedCodec("foo", nil)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if pm2, err = LoadEncryptedPersistentMap(filename+BackupSuffix, "foo"); err != nil ||
+		pm2.Data["token"] != "substitutedtoken" {
+		t.Error("Unexpected data in map:", pm2.Data, err)
+		return
+	}
+
+	// The unencrypted write-ahead log cannot be used
+
+	options := PersistentMapOptions{WAL: true, Codec: EncryptedCodec("foo", nil)}
+
+	if _, err = NewPersistentMapWithOptions(filepath.Join(dir, "testencryptedwalmap.map"), options); err == nil ||
+		err.Error() != "Write-ahead log cannot be used with codec: encrypted" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = LoadPersistentMapWithOptions(filename+BackupSuffix, options); err == nil ||
+		err.Error() != "Write-ahead log cannot be used with codec: encrypted" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "testencryptedwalmap.map"+WALSuffix)); !os.IsNotExist(err) {
+		t.Error("Unexpected result:", err)
+		return
+	}
+}
+
+func TestTypedPersistentMap(t *testing.T) {
+	type entry struct {
+		Name  string
+		Count int
+	}
+
+	filename := testdbdir + "/testtypedmap.map"
+
+	for _, options := range []PersistentMapOptions{
+		{Codec: JSONCodec},
+		{Codec: JSONCodec, WAL: true},
+	} {
+		os.Remove(filename)
+		os.Remove(filename + WALSuffix)
+
+		pm, err := NewTypedPersistentMap[entry](filename, options)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		pm.Put("a", entry{"foo", 1})
+		pm.Put("b", entry{"bar", 2})
+
+		if err := pm.Flush(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		pm.Delete("b")
+		pm.Put("c", entry{"baz", 3})
+
+		if err := pm.Flush(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// JSON keeps the type of the values
+
+		pm2, err := LoadTypedPersistentMap[entry](filename, options)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if res := fmt.Sprint(pm2.Data); res != "map[a:{foo 1} c:{baz 3}]" || pm2.Data["c"].Count != 3 {
+			t.Error("Unexpected result:", res)
+			return
+		}
+	}
+}
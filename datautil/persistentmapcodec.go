@@ -0,0 +1,277 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+Codec encodes and decodes the data of persistent maps.
+*/
+type Codec interface {
+
+	/*
+		Name returns the name of the codec which is stored in the file header.
+	*/
+	Name() string
+
+	/*
+		Encode writes the given data to a given writer.
+	*/
+	Encode(w io.Writer, data interface{}) error
+
+	/*
+		Decode reads data from a given reader into a given pointer.
+	*/
+	Decode(r io.Reader, data interface{}) error
+}
+
+/*
+secureCodec is implemented by codecs which protect the stored data (e.g. by
+encryption). Such a codec only decodes files whose header names it, so the
+data cannot be substituted with a file in another format.
+*/
+type secureCodec interface {
+	Codec
+
+	/*
+		checkName checks the codec name in the header of a file before it is
+		decoded. The name is empty for files without header.
+	*/
+	checkName(name string) error
+}
+
+/*
+codecHeader is the start of the header line of files which were written
+with an explicit codec. The header line is followed by the codec name and
+a newline. Files without a header line are gob encoded.
+*/
+const codecHeader = "#persistentmap:"
+
+/*
+GobCodec encodes persistent maps with encoding/gob.
+*/
+var GobCodec Codec = &gobCodec{}
+
+/*
+JSONCodec encodes persistent maps as indented JSON. Note that JSON does not
+preserve Go types - values of a PersistentMap are loaded as the generic JSON
+types, e.g. all numbers become float64, all slices []interface{} and all
+structs and maps map[string]interface{}.
+*/
+var JSONCodec Codec = &jsonCodec{}
+
+/*
+codecs holds all known codecs by name.
+*/
+var codecs = map[string]Codec{
+	GobCodec.Name():  GobCodec,
+	JSONCodec.Name(): JSONCodec,
+}
+
+/*
+codecsLock protects the codecs map.
+*/
+var codecsLock = &sync.RWMutex{}
+
+/*
+init registers the generic JSON types with gob so values which were loaded
+from a JSON file can be written with gob again.
+*/
+func init() {
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+/*
+RegisterCodec registers a custom codec so files which were written with it
+can be detected when loading.
+*/
+func RegisterCodec(codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+/*
+ConvertPersistentMap rewrites the file of a PersistentMap with a given codec.
+Values keep their types only if both codecs preserve them. Converting from
+JSON produces the generic JSON types (see JSONCodec), e.g. an int which was
+converted to JSON and back to gob is a float64 afterwards.
+*/
+func ConvertPersistentMap(filename string, codec Codec) error {
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+
+	pm := &PersistentMap{filename, make(map[string]interface{}), PersistentMapOptions{Codec: codec}, nil}
+
+	err := decodeMapFile(filename, false, nil, &pm.Data)
+
+	if err == nil {
+		err = pm.Flush()
+	}
+
+	return err
+}
+
+/*
+ConvertPersistentStringMap rewrites the file of a PersistentStringMap with a
+given codec.
+*/
+func ConvertPersistentStringMap(filename string, codec Codec) error {
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+
+	pm := &PersistentStringMap{filename, make(map[string]string), PersistentMapOptions{Codec: codec}}
+
+	err := decodeMapFile(filename, false, nil, &pm.Data)
+
+	if err == nil {
+		err = pm.Flush()
+	}
+
+	return err
+}
+
+/*
+encodeMap writes the given data with a given codec. A nil codec writes plain
+gob without header.
+*/
+func encodeMap(w io.Writer, codec Codec, data interface{}) error {
+	if codec == nil {
+		return gob.NewEncoder(w).Encode(data)
+	}
+
+	if _, err := fmt.Fprintf(w, "%v%v\n", codecHeader, codec.Name()); err != nil {
+		return err
+	}
+
+	return codec.Encode(w, data)
+}
+
+/*
+decodeMap reads data with the codec which is named in the header. Data
+without header is decoded with gob. A given codec is used if the header
+names it, otherwise the registered codecs are used. A given secure codec
+must be named in the header.
+*/
+func decodeMap(r io.Reader, codec Codec, data interface{}) error {
+	br := bufio.NewReader(r)
+
+	sc, secure := codec.(secureCodec)
+
+	if prefix, _ := br.Peek(len(codecHeader)); !bytes.Equal(prefix, []byte(codecHeader)) {
+
+		// Empty data is rejected as well - it could be a truncated file
+
+		if secure {
+			if err := sc.checkName(""); err != nil {
+				return err
+			}
+		}
+
+		return gob.NewDecoder(br).Decode(data)
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Invalid codec header: %v", err)
+	}
+
+	name := line[len(codecHeader) : len(line)-1]
+
+	if secure {
+		if err := sc.checkName(name); err != nil {
+			return err
+		}
+	}
+
+	if codec == nil || codec.Name() != name {
+		var ok bool
+
+		codecsLock.RLock()
+		codec, ok = codecs[name]
+		codecsLock.RUnlock()
+
+		if !ok {
+			return fmt.Errorf("Unknown codec: %v", name)
+		}
+	}
+
+	return codec.Decode(br, data)
+}
+
+/*
+gobCodec is the gob codec implementation.
+*/
+type gobCodec struct {
+}
+
+/*
+Name returns the name of the codec.
+*/
+func (c *gobCodec) Name() string {
+	return "gob"
+}
+
+/*
+Encode writes the given data to a given writer.
+*/
+func (c *gobCodec) Encode(w io.Writer, data interface{}) error {
+	return gob.NewEncoder(w).Encode(data)
+}
+
+/*
+Decode reads data from a given reader into a given pointer.
+*/
+func (c *gobCodec) Decode(r io.Reader, data interface{}) error {
+	return gob.NewDecoder(r).Decode(data)
+}
+
+/*
+jsonCodec is the JSON codec implementation.
+*/
+type jsonCodec struct {
+}
+
+/*
+Name returns the name of the codec.
+*/
+func (c *jsonCodec) Name() string {
+	return "json"
+}
+
+/*
+Encode writes the given data to a given writer.
+*/
+func (c *jsonCodec) Encode(w io.Writer, data interface{}) error {
+	en := json.NewEncoder(w)
+	en.SetIndent("", "  ")
+
+	return en.Encode(data)
+}
+
+/*
+Decode reads data from a given reader into a given pointer.
+*/
+func (c *jsonCodec) Decode(r io.Reader, data interface{}) error {
+	return json.NewDecoder(r).Decode(data)
+}
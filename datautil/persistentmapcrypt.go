@@ -0,0 +1,134 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/rhedin/Abe_common/cryptutil"
+)
+
+/*
+NewEncryptedPersistentMap creates a new persistent map which is stored
+encrypted with a given passphrase.
+*/
+func NewEncryptedPersistentMap(filename string, passphrase string) (*PersistentMap, error) {
+	return NewPersistentMapWithOptions(filename,
+		PersistentMapOptions{Codec: EncryptedCodec(passphrase, nil)})
+}
+
+/*
+LoadEncryptedPersistentMap loads an encrypted persistent map from a file.
+Returns cryptutil.ErrAuthentication if the file was modified or the wrong
+passphrase was given.
+*/
+func LoadEncryptedPersistentMap(filename string, passphrase string) (*PersistentMap, error) {
+	return LoadPersistentMapWithOptions(filename,
+		PersistentMapOptions{Codec: EncryptedCodec(passphrase, nil)})
+}
+
+/*
+NewEncryptedPersistentStringMap creates a new persistent string map which is
+stored encrypted with a given passphrase.
+*/
+func NewEncryptedPersistentStringMap(filename string, passphrase string) (*PersistentStringMap, error) {
+	return NewPersistentStringMapWithOptions(filename,
+		PersistentMapOptions{Codec: EncryptedCodec(passphrase, nil)})
+}
+
+/*
+LoadEncryptedPersistentStringMap loads an encrypted persistent string map from
+a file. Returns cryptutil.ErrAuthentication if the file was modified or the
+wrong passphrase was given.
+*/
+func LoadEncryptedPersistentStringMap(filename string, passphrase string) (*PersistentStringMap, error) {
+	return LoadPersistentStringMapWithOptions(filename,
+		PersistentMapOptions{Codec: EncryptedCodec(passphrase, nil)})
+}
+
+/*
+EncryptedCodec returns a codec which encrypts the output of a given codec
+(gob if nil) in the same way as the UserDB. The encrypted data is
+authenticated so modifications are detected. Only files which were written
+with this codec are loaded with it. The codec cannot be used together with
+the write-ahead log of a persistent map since the log is not encrypted.
+*/
+func EncryptedCodec(passphrase string, codec Codec) Codec {
+	return &encryptedCodec{passphrase, codec}
+}
+
+/*
+encryptedCodec is the encrypting codec implementation.
+*/
+type encryptedCodec struct {
+	passphrase string // Encryption passphrase
+	codec      Codec  // Codec for the unencrypted data
+}
+
+/*
+Name returns the name of the codec.
+*/
+func (c *encryptedCodec) Name() string {
+	return "encrypted"
+}
+
+/*
+checkName checks the codec name in the header of a file before it is decoded.
+Files which were not written with this codec are rejected as modified.
+*/
+func (c *encryptedCodec) checkName(name string) error {
+	if name != c.Name() {
+		return cryptutil.ErrAuthentication
+	}
+
+	return nil
+}
+
+/*
+Encode writes the given data to a given writer.
+*/
+func (c *encryptedCodec) Encode(w io.Writer, data interface{}) error {
+	var buf bytes.Buffer
+
+	err := encodeMap(&buf, c.codec, data)
+
+	if err == nil {
+		var encContent string
+
+		encContent, err = cryptutil.EncryptStringAuthenticated(c.passphrase, buf.String())
+
+		if err == nil {
+			_, err = io.WriteString(w, encContent)
+		}
+	}
+
+	return err
+}
+
+/*
+Decode reads data from a given reader into a given pointer.
+*/
+func (c *encryptedCodec) Decode(r io.Reader, data interface{}) error {
+	encContent, err := io.ReadAll(r)
+
+	if err == nil {
+		var content string
+
+		content, err = cryptutil.DecryptStringAuthenticated(c.passphrase, string(encContent))
+
+		if err == nil {
+			err = decodeMap(strings.NewReader(content), c.codec, data)
+		}
+	}
+
+	return err
+}
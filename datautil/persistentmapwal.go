@@ -0,0 +1,194 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+WALSuffix is the suffix of the write-ahead log file of a persistent map.
+*/
+const WALSuffix = ".wal"
+
+/*
+DefaultCompactAfter is the default number of log records after which the
+write-ahead log of a persistent map is compacted.
+*/
+const DefaultCompactAfter = 1000
+
+/*
+walRecord is a single change in the write-ahead log.
+*/
+type walRecord[V any] struct {
+	Delete bool   // Flag if the key was deleted
+	Key    string // Changed key
+	Value  V      // New value of the key
+}
+
+/*
+walLog is the write-ahead log of a persistent map. The log file consists of
+records which are each prefixed by their length. Each record is gob encoded
+on its own so a partly written record at the end of the file can be detected
+and discarded. Records are always gob encoded regardless of the codec option.
+Only keys which were reported as changed are written to the log.
+*/
+type walLog[V any] struct {
+	filename string              // File of the log
+	changed  map[string]struct{} // Keys which were changed since the last flush
+	records  int                 // Number of records in the log
+}
+
+/*
+newWalLog creates a new write-ahead log object for a given map file. The log
+cannot be used together with a secure codec since the records are written
+unprotected.
+*/
+func newWalLog[V any](filename string, codec Codec) (*walLog[V], error) {
+	if _, ok := codec.(secureCodec); ok {
+		return nil, fmt.Errorf("Write-ahead log cannot be used with codec: %v", codec.Name())
+	}
+
+	return &walLog[V]{filename + WALSuffix, make(map[string]struct{}), 0}, nil
+}
+
+/*
+replay applies all records of the log file to the given data. A partly
+written record at the end of the log is removed from the file.
+*/
+func (wl *walLog[V]) replay(data map[string]V) error {
+	file, err := os.OpenFile(wl.filename, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	var header [4]byte
+
+	for {
+		var record walRecord[V]
+
+		if _, err = io.ReadFull(file, header[:]); err == nil {
+			buf := make([]byte, binary.BigEndian.Uint32(header[:]))
+
+			if _, err = io.ReadFull(file, buf); err == nil {
+				err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&record)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+
+		if record.Delete {
+			delete(data, record.Key)
+		} else {
+			data[record.Key] = record.Value
+		}
+
+		offset += int64(len(header)) + int64(binary.BigEndian.Uint32(header[:]))
+		wl.records++
+	}
+
+	if err == io.EOF {
+		return nil
+	}
+
+	// Remove the broken record so new records can be appended
+
+	return file.Truncate(offset)
+}
+
+/*
+clear empties the log file and forgets all changes.
+*/
+func (wl *walLog[V]) clear() error {
+	err := wl.truncate()
+
+	if err == nil {
+		wl.changed = make(map[string]struct{})
+	}
+
+	return err
+}
+
+/*
+truncate empties the log file.
+*/
+func (wl *walLog[V]) truncate() error {
+	err := os.WriteFile(wl.filename, nil, 0660)
+
+	if err == nil {
+		wl.records = 0
+	}
+
+	return err
+}
+
+/*
+write appends the given records to the log file.
+*/
+func (wl *walLog[V]) write(records []walRecord[V]) error {
+	var buf bytes.Buffer
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	for _, record := range records {
+		if err := writeWalRecord(&buf, record); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(wl.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(buf.Bytes()); err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		wl.records += len(records)
+	}
+
+	return err
+}
+
+/*
+writeWalRecord writes a length prefixed record to a given buffer.
+*/
+func writeWalRecord[V any](buf *bytes.Buffer, record walRecord[V]) error {
+	var rbuf bytes.Buffer
+	var header [4]byte
+
+	if err := gob.NewEncoder(&rbuf).Encode(record); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(header[:], uint32(rbuf.Len()))
+
+	buf.Write(header[:])
+	buf.Write(rbuf.Bytes())
+
+	return nil
+}
@@ -13,40 +13,144 @@ Package datautil contains general data handling objects and helper methods.
 package datautil
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 )
 
+/*
+RingBufferInterface is the common API of RingBuffer and FileRingBuffer.
+*/
+type RingBufferInterface interface {
+
+	/*
+		Reset removes all content from the ringbuffer.
+	*/
+	Reset()
+
+	/*
+		IsEmpty returns if this ringbuffer is empty.
+	*/
+	IsEmpty() bool
+
+	/*
+		Size returns the size of the ringbuffer.
+	*/
+	Size() int
+
+	/*
+		Get returns an element of the ringbuffer from a given position.
+	*/
+	Get(p int) interface{}
+
+	/*
+		Add adds an item to the ringbuffer.
+	*/
+	Add(e interface{})
+
+	/*
+		Poll removes and returns the head of the ringbuffer. Returns nil if
+		the ringbuffer is empty.
+	*/
+	Poll() interface{}
+
+	/*
+		Log writes the given arguments as strings into the ring buffer. Each
+		line is a separate item.
+	*/
+	Log(v ...interface{})
+
+	/*
+		Slice returns the contents of the buffer as a slice.
+	*/
+	Slice() []interface{}
+
+	/*
+		StringSlice returns the contents of the buffer as a slice of strings.
+	*/
+	StringSlice() []string
+
+	/*
+		String returns the contents of the buffer as a string.
+	*/
+	String() string
+}
+
+/*
+Make sure RingBuffer implements the common ringbuffer API.
+*/
+var _ RingBufferInterface = &RingBuffer{}
+
 /*
 RingBuffer is a classic thread-safe ringbuffer implementation. It stores
 abstract interface{} objects. It has specific methods so it can be used as
 a print logger.
 */
 type RingBuffer struct {
-	data     []interface{} // Elements of this ring buffer
+	*TypedRingBuffer[interface{}]
+}
+
+/*
+NewRingBuffer creates a new ringbuffer with a given size.
+*/
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{NewTypedRingBuffer[interface{}](size)}
+}
+
+/*
+Poll removes and returns the head of the ringbuffer. Returns nil if the
+ringbuffer is empty.
+*/
+func (rb *RingBuffer) Poll() interface{} {
+	i, _ := rb.TypedRingBuffer.Poll()
+	return i
+}
+
+/*
+Log writes the given arguments as strings into the ring buffer. Each line is a
+separate item.
+*/
+func (rb *RingBuffer) Log(v ...interface{}) {
+	lines := strings.Split(fmt.Sprint(v...), "\n")
+
+	for _, line := range lines {
+		rb.Add(line)
+	}
+}
+
+/*
+TypedRingBuffer is a thread-safe ringbuffer which stores objects of a given
+type.
+*/
+type TypedRingBuffer[T any] struct {
+	data     []T           // Elements of this ring buffer
 	size     int           // Size of the ring buffer
 	first    int           // First item of the ring buffer
 	last     int           // Last item of the ring buffer
 	modCount int           // Check for modifications during iterations
 	lock     *sync.RWMutex // Lock for RingBuffer
+
+	signal chan struct{}                           // Channel which is closed when an item is added
+	subs   map[*RingBufferSubscription[T]]struct{} // Subscriptions of the ring buffer
 }
 
 /*
-NewRingBuffer creates a new ringbuffer with a given size.
+NewTypedRingBuffer creates a new typed ringbuffer with a given size.
 */
-func NewRingBuffer(size int) *RingBuffer {
-	return &RingBuffer{make([]interface{}, size), 0, 0, 0, 0, &sync.RWMutex{}}
+func NewTypedRingBuffer[T any](size int) *TypedRingBuffer[T] {
+	return &TypedRingBuffer[T]{make([]T, size), 0, 0, 0, 0, &sync.RWMutex{},
+		make(chan struct{}), make(map[*RingBufferSubscription[T]]struct{})}
 }
 
 /*
 Reset removes all content from the ringbuffer.
 */
-func (rb *RingBuffer) Reset() {
+func (rb *TypedRingBuffer[T]) Reset() {
 	rb.lock.Lock()
 	defer rb.lock.Unlock()
 
-	rb.data = make([]interface{}, cap(rb.data))
+	rb.data = make([]T, cap(rb.data))
 	rb.size = 0
 	rb.first = 0
 	rb.last = 0
@@ -56,7 +160,7 @@ func (rb *RingBuffer) Reset() {
 /*
 IsEmpty returns if this ringbuffer is empty.
 */
-func (rb *RingBuffer) IsEmpty() bool {
+func (rb *TypedRingBuffer[T]) IsEmpty() bool {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
@@ -66,7 +170,7 @@ func (rb *RingBuffer) IsEmpty() bool {
 /*
 Size returns the size of the ringbuffer.
 */
-func (rb *RingBuffer) Size() int {
+func (rb *TypedRingBuffer[T]) Size() int {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
@@ -76,7 +180,7 @@ func (rb *RingBuffer) Size() int {
 /*
 Get returns an element of the ringbuffer from a given position.
 */
-func (rb *RingBuffer) Get(p int) interface{} {
+func (rb *TypedRingBuffer[T]) Get(p int) T {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
@@ -86,10 +190,25 @@ func (rb *RingBuffer) Get(p int) interface{} {
 /*
 Add adds an item to the ringbuffer.
 */
-func (rb *RingBuffer) Add(e interface{}) {
+func (rb *TypedRingBuffer[T]) Add(e T) {
 	rb.lock.Lock()
 	defer rb.lock.Unlock()
 
+	rb.add(e)
+
+	for sub := range rb.subs {
+		sub.publish(e)
+	}
+}
+
+/*
+add adds an item to the ringbuffer and wakes up all waiting consumers.
+Returns true if the oldest item was overwritten. The caller must hold the
+writer lock.
+*/
+func (rb *TypedRingBuffer[T]) add(e T) bool {
+	var overwritten bool
+
 	ld := len(rb.data)
 
 	rb.data[rb.last] = e
@@ -97,55 +216,148 @@ func (rb *RingBuffer) Add(e interface{}) {
 
 	if rb.size == ld {
 		rb.first = (rb.first + 1) % ld
+		overwritten = true
 	} else {
 		rb.size++
 	}
 
 	rb.modCount++
+
+	rb.wake()
+
+	return overwritten
 }
 
 /*
-Poll removes and returns the head of the ringbuffer.
+wake wakes up all consumers which wait for new items. The caller must hold
+the writer lock.
 */
-func (rb *RingBuffer) Poll() interface{} {
+func (rb *TypedRingBuffer[T]) wake() {
+	close(rb.signal)
+	rb.signal = make(chan struct{})
+}
+
+/*
+Poll removes and returns the head of the ringbuffer. The second return value
+is false if the ringbuffer is empty.
+*/
+func (rb *TypedRingBuffer[T]) Poll() (T, bool) {
+	var zero T
+
 	rb.lock.Lock()
 	defer rb.lock.Unlock()
 
 	if rb.size == 0 {
-		return nil
+		return zero, false
 	}
 
 	i := rb.data[rb.first]
-	rb.data[rb.first] = nil
+	rb.data[rb.first] = zero
 
 	rb.size--
 	rb.first = (rb.first + 1) % len(rb.data)
 	rb.modCount++
 
-	return i
+	return i, true
 }
 
 /*
-Log writes the given arguments as strings into the ring buffer. Each line is a
-separate item.
+PollWait removes and returns the head of the ringbuffer. Waits for a new item
+if the ringbuffer is empty. Returns the error of the given context if it is
+done before an item was added.
 */
-func (rb *RingBuffer) Log(v ...interface{}) {
-	lines := strings.Split(fmt.Sprint(v...), "\n")
+func (rb *TypedRingBuffer[T]) PollWait(ctx context.Context) (T, error) {
+	for {
+		var zero T
 
-	for _, line := range lines {
-		rb.Add(line)
+		rb.lock.Lock()
+
+		signal := rb.signal
+
+		if rb.size > 0 {
+			i := rb.data[rb.first]
+			rb.data[rb.first] = zero
+
+			rb.size--
+			rb.first = (rb.first + 1) % len(rb.data)
+			rb.modCount++
+
+			rb.lock.Unlock()
+
+			return i, nil
+		}
+
+		rb.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-signal:
+		}
+	}
+}
+
+/*
+Chan returns a channel which streams the items of the ringbuffer. Items are
+removed from the ringbuffer as they are sent to the channel. The channel is
+closed once the given context is done.
+*/
+func (rb *TypedRingBuffer[T]) Chan(ctx context.Context) <-chan T {
+	c := make(chan T)
+
+	go func() {
+		defer close(c)
+
+		for {
+			i, err := rb.PollWait(ctx)
+
+			if err != nil {
+				return
+			}
+
+			select {
+			case c <- i:
+			case <-ctx.Done():
+				rb.unpoll(i)
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+/*
+unpoll puts a polled item back at the head of the ringbuffer. The item is
+dropped if the ringbuffer has been filled up in the meantime since it would
+have been overwritten as the oldest item.
+*/
+func (rb *TypedRingBuffer[T]) unpoll(e T) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	ld := len(rb.data)
+
+	if rb.size < ld {
+		rb.first = (rb.first - 1 + ld) % ld
+		rb.data[rb.first] = e
+
+		rb.size++
+		rb.modCount++
+
+		rb.wake()
 	}
 }
 
 /*
 Slice returns the contents of the buffer as a slice.
 */
-func (rb *RingBuffer) Slice() []interface{} {
+func (rb *TypedRingBuffer[T]) Slice() []T {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
 	ld := len(rb.data)
-	ret := make([]interface{}, rb.size)
+	ret := make([]T, rb.size)
 
 	for i := 0; i < rb.size; i++ {
 		ret[i] = rb.data[(i+rb.first)%ld]
@@ -158,7 +370,7 @@ func (rb *RingBuffer) Slice() []interface{} {
 StringSlice returns the contents of the buffer as a slice of strings.
 Each item of the buffer is a separate string.
 */
-func (rb *RingBuffer) StringSlice() []string {
+func (rb *TypedRingBuffer[T]) StringSlice() []string {
 	rb.lock.RLock()
 	defer rb.lock.RUnlock()
 
@@ -176,6 +388,6 @@ func (rb *RingBuffer) StringSlice() []string {
 String retusn the contents of the buffer as a string. Each item of the buffer is
 treated as a separate line.
 */
-func (rb *RingBuffer) String() string {
+func (rb *TypedRingBuffer[T]) String() string {
 	return strings.Join(rb.StringSlice(), "\n")
 }
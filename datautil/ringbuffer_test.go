@@ -10,8 +10,10 @@
 package datautil
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestRingBuffer(t *testing.T) {
@@ -113,3 +115,186 @@ EEE`[1:] {
 		return
 	}
 }
+
+func TestTypedRingBuffer(t *testing.T) {
+
+	rb := NewTypedRingBuffer[int](3)
+
+	if v, ok := rb.Poll(); ok || v != 0 {
+		t.Error("Initial buffer should be empty")
+		return
+	}
+
+	for i := 1; i < 5; i++ {
+		rb.Add(i)
+	}
+
+	if res := rb.Slice(); fmt.Sprint(res) != "[2 3 4]" || rb.Get(1)+1 != 4 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := rb.String(); res != "2\n3\n4" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if v, ok := rb.Poll(); !ok || v != 2 || rb.Size() != 2 {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	rb.Reset()
+
+	if !rb.IsEmpty() {
+		t.Error("Buffer should be empty")
+		return
+	}
+}
+
+func TestRingBufferPollWait(t *testing.T) {
+
+	rb := NewRingBuffer(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if res, err := rb.PollWait(ctx); res != nil || err != context.DeadlineExceeded {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rb.Add("AAA")
+	}()
+
+	if res, err := rb.PollWait(context.Background()); res != "AAA" || err != nil || !rb.IsEmpty() {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	// Channel view
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	c := rb.Chan(ctx2)
+
+	rb.Log("BBB\nCCC")
+
+	if res := <-c; res != "BBB" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := <-c; res != "CCC" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	rb.Add("DDD")
+
+	// Wait until the item was taken from the buffer
+
+	for i := 0; !rb.IsEmpty() && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel2()
+
+	if _, ok := <-c; ok {
+		t.Error("Channel should be closed")
+		return
+	}
+
+	// Items which could not be delivered are put back
+
+	if res := rb.Poll(); res != "DDD" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
+
+func TestRingBufferSubscribe(t *testing.T) {
+
+	rb := NewRingBuffer(10)
+
+	rb.Add("AAA")
+
+	sub := rb.Subscribe(2)
+	sub2 := rb.Subscribe(0)
+
+	rb.Log("BBB\nCCC\nDDD")
+
+	// The slow subscriber missed an item
+
+	if res, missed, err := sub.Next(context.Background()); res != "CCC" || missed != 1 || err != nil {
+		t.Error("Unexpected result:", res, missed, err)
+		return
+	}
+
+	if res, missed, err := sub.Next(context.Background()); res != "DDD" || missed != 0 || err != nil {
+		t.Error("Unexpected result:", res, missed, err)
+		return
+	}
+
+	if res, missed, err := sub2.Next(context.Background()); res != "BBB" || missed != 0 || err != nil {
+		t.Error("Unexpected result:", res, missed, err)
+		return
+	}
+
+	// Subscribers do not consume items of the ring buffer
+
+	if res := rb.String(); res != "AAA\nBBB\nCCC\nDDD" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rb.Add("EEE")
+	}()
+
+	if res, _, err := sub.Next(context.Background()); res != "EEE" || err != nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := sub.Next(ctx); err != context.DeadlineExceeded {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Closing wakes up waiting subscribers
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sub.Close()
+	}()
+
+	if _, _, err := sub.Next(context.Background()); err != ErrSubscriptionClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	sub.Close()
+	sub2.Close()
+
+	rb.Add("FFF")
+
+	// Queued items can still be read after closing
+
+	if res, _, err := sub2.Next(context.Background()); res != "CCC" || err != nil {
+		t.Error("Unexpected result:", res, err)
+		return
+	}
+
+	if len(rb.subs) != 0 {
+		t.Error("Unexpected subscriptions:", rb.subs)
+		return
+	}
+}
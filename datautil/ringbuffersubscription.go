@@ -0,0 +1,138 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+/*
+ErrSubscriptionClosed is returned when reading from a closed subscription.
+*/
+var ErrSubscriptionClosed = errors.New("Subscription is closed")
+
+/*
+RingBufferSubscription receives all items which are added to a ring buffer
+after the subscription was made. Items are queued in a ring buffer of their
+own - if a subscriber is too slow the oldest queued items are overwritten
+and the number of missed items is reported with the next item.
+*/
+type RingBufferSubscription[T any] struct {
+	rb     *TypedRingBuffer[T] // Ring buffer of the subscription
+	queue  *TypedRingBuffer[T] // Items which have not been read
+	missed int                 // Number of overwritten items since the last read
+	closed bool                // Flag if the subscription was closed
+	lock   *sync.Mutex         // Lock for the subscription
+}
+
+/*
+Subscribe creates a new subscription which receives all items which are added
+to the ringbuffer from now on. The subscription queues up to a given number
+of items (the size of the ringbuffer if 0 or less).
+*/
+func (rb *TypedRingBuffer[T]) Subscribe(size int) *RingBufferSubscription[T] {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	if size <= 0 {
+		size = len(rb.data)
+	}
+
+	sub := &RingBufferSubscription[T]{rb, NewTypedRingBuffer[T](size), 0, false, &sync.Mutex{}}
+
+	rb.subs[sub] = struct{}{}
+
+	return sub
+}
+
+/*
+Next returns the next item of the subscription and the number of items which
+were missed before it because the subscriber was too slow. Waits for a new
+item if there is none. Returns the error of the given context if it is done
+before an item was added and ErrSubscriptionClosed if the subscription was
+closed.
+*/
+func (sub *RingBufferSubscription[T]) Next(ctx context.Context) (T, int, error) {
+	for {
+		var zero T
+
+		sub.lock.Lock()
+
+		item, ok := sub.queue.Poll()
+		missed := sub.missed
+		closed := sub.closed
+		signal := sub.queue.waitSignal()
+
+		if ok {
+			sub.missed = 0
+		}
+
+		sub.lock.Unlock()
+
+		if ok {
+			return item, missed, nil
+		} else if closed {
+			return zero, 0, ErrSubscriptionClosed
+		}
+
+		select {
+		case <-ctx.Done():
+			return zero, 0, ctx.Err()
+		case <-signal:
+		}
+	}
+}
+
+/*
+Close ends the subscription. Items which were already queued can still be read.
+*/
+func (sub *RingBufferSubscription[T]) Close() {
+	sub.rb.lock.Lock()
+	delete(sub.rb.subs, sub)
+	sub.rb.lock.Unlock()
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	if !sub.closed {
+		sub.closed = true
+
+		sub.queue.lock.Lock()
+		sub.queue.wake()
+		sub.queue.lock.Unlock()
+	}
+}
+
+/*
+publish queues a new item for the subscriber.
+*/
+func (sub *RingBufferSubscription[T]) publish(e T) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.queue.lock.Lock()
+	defer sub.queue.lock.Unlock()
+
+	if sub.queue.add(e) {
+		sub.missed++
+	}
+}
+
+/*
+waitSignal returns a channel which is closed once the next item is added.
+*/
+func (rb *TypedRingBuffer[T]) waitSignal() <-chan struct{} {
+	rb.lock.RLock()
+	defer rb.lock.RUnlock()
+
+	return rb.signal
+}
@@ -12,12 +12,9 @@ package datautil
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -55,24 +52,90 @@ var GoodPasswordLength = 12
 
 /*
 UserDB is a thread-safe user database which is stored in an encrypted
-file. User passwords are hashed with an individual salt.
+file. User passwords are hashed with an individual salt using PBKDF2. Hashes
+of older entries are upgraded on the next successful password check. Failed
+login attempts which are checked with CheckUserPasswordFrom are counted by
+a login throttle.
 */
 type UserDB struct {
 	filename   string                  // File of the persistent map
 	passphrase string                  // Encryption passphrase
 	Data       map[string]*userDBEntry // Data of the persistent map
 	DataLock   *sync.RWMutex           // Lock for data
+	Throttle   *LoginThrottle          // Throttle for failed login attempts
 }
 
 /*
 userDBEntry models an entry in the user database.
 */
 type userDBEntry struct {
-	Passhash        string                 // Password hash for user
-	Salt            []byte                 // Password salt for user
-	PasshashHistory []string               // Password hash history
-	SaltHistory     [][]byte               // Password salt history
-	Data            map[string]interface{} // User data
+	Passhash         string                 // Password hash for user
+	Salt             []byte                 // Password salt for user
+	PasshashHistory  []string               // Password hash history
+	SaltHistory      [][]byte               // Password salt history
+	Data             map[string]interface{} // User data
+	Algorithm        string                 // Password hash algorithm for user
+	Cost             int                    // Password hash cost for user
+	AlgorithmHistory []string               // Password hash algorithm history
+	CostHistory      []int                  // Password hash cost history
+}
+
+/*
+passwordHash returns the current password hash of the entry.
+*/
+func (e *userDBEntry) passwordHash() *passwordHash {
+	return &passwordHash{e.Algorithm, e.Cost, e.Salt, e.Passhash}
+}
+
+/*
+historyHash returns a password hash from the password history. Entries which
+were stored before the algorithm was recorded use the old SHA-256 hash.
+*/
+func (e *userDBEntry) historyHash(i int) *passwordHash {
+	ph := &passwordHash{PasswordHashSHA256, 0, e.SaltHistory[i], e.PasshashHistory[i]}
+
+	if i < len(e.AlgorithmHistory) {
+		ph.algorithm = e.AlgorithmHistory[i]
+		ph.cost = e.CostHistory[i]
+	}
+
+	return ph
+}
+
+/*
+setPasswordHash sets a new password hash for the entry. The old hash is
+kept in the password history if the keepHistory flag is set.
+*/
+func (e *userDBEntry) setPasswordHash(ph *passwordHash, keepHistory bool) {
+
+	if keepHistory {
+
+		// Record the algorithms of older history entries before they are moved
+
+		for i := len(e.AlgorithmHistory); i < len(e.PasshashHistory); i++ {
+			e.AlgorithmHistory = append(e.AlgorithmHistory, PasswordHashSHA256)
+			e.CostHistory = append(e.CostHistory, 0)
+		}
+
+		// Store old hash in the history
+
+		if len(e.PasshashHistory) < MaxPassHistory {
+			e.PasshashHistory = append(e.PasshashHistory, e.Passhash)
+			e.SaltHistory = append(e.SaltHistory, e.Salt)
+			e.AlgorithmHistory = append(e.AlgorithmHistory, e.Algorithm)
+			e.CostHistory = append(e.CostHistory, e.Cost)
+		} else {
+			e.PasshashHistory = append(e.PasshashHistory[1:], e.Passhash)
+			e.SaltHistory = append(e.SaltHistory[1:], e.Salt)
+			e.AlgorithmHistory = append(e.AlgorithmHistory[1:], e.Algorithm)
+			e.CostHistory = append(e.CostHistory[1:], e.Cost)
+		}
+	}
+
+	e.Passhash = ph.hash
+	e.Salt = ph.salt
+	e.Algorithm = ph.algorithm
+	e.Cost = ph.cost
 }
 
 /*
@@ -85,7 +148,7 @@ func NewUserDB(filename string, passphrase string) (*UserDB, error) {
 
 	if err == nil {
 		ud = &UserDB{filename, passphrase, make(map[string]*userDBEntry),
-			&sync.RWMutex{}}
+			&sync.RWMutex{}, NewLoginThrottle()}
 
 		if ok {
 			err = ud.load()
@@ -105,8 +168,6 @@ func NewUserDB(filename string, passphrase string) (*UserDB, error) {
 AddUserEntry adds a new user entry.
 */
 func (ud *UserDB) AddUserEntry(name, password string, data map[string]interface{}) error {
-	var err error
-
 	ud.DataLock.Lock()
 	defer ud.DataLock.Unlock()
 
@@ -114,23 +175,19 @@ func (ud *UserDB) AddUserEntry(name, password string, data map[string]interface{
 		return fmt.Errorf("User %v already exists", name)
 	}
 
-	// Generate a salt for the user
-
-	salt := make([]byte, sha256.Size)
+	// Hash the password with a new salt for the user
 
-	if _, err = io.ReadFull(rand.Reader, salt); err == nil {
+	ph, err := newPasswordHash(password)
 
-		// Hash the password
-
-		passhash := sha256.Sum256(append(salt, []byte(password)...))
-
-		ud.Data[name] = &userDBEntry{
-			Passhash:        string((&passhash)[:]),
-			Salt:            salt,
+	if err == nil {
+		e := &userDBEntry{
 			PasshashHistory: []string{},
 			Data:            data,
 		}
 
+		e.setPasswordHash(ph, false)
+		ud.Data[name] = e
+
 		err = ud.flush()
 	}
 
@@ -159,8 +216,6 @@ func (ud *UserDB) UpdateUserData(name string, data map[string]interface{}) error
 UpdateUserPassword updates the password of a user entry.
 */
 func (ud *UserDB) UpdateUserPassword(name, password string) error {
-	var err error
-
 	if ud.CheckUserPassword(name, password) {
 		return fmt.Errorf("Cannot reuse current password")
 	}
@@ -176,25 +231,13 @@ func (ud *UserDB) UpdateUserPassword(name, password string) error {
 
 	// Generate a new salt and passhash for the user
 
-	salt := make([]byte, sha256.Size)
-
-	if _, err = io.ReadFull(rand.Reader, salt); err == nil {
-		passhash := sha256.Sum256(append(salt, []byte(password)...))
+	ph, err := newPasswordHash(password)
 
-		// Store old hash in the history
-
-		if len(e.PasshashHistory) < MaxPassHistory {
-			e.PasshashHistory = append(e.PasshashHistory, e.Passhash)
-			e.SaltHistory = append(e.SaltHistory, e.Salt)
-		} else {
-			e.PasshashHistory = append(e.PasshashHistory[1:], e.Passhash)
-			e.SaltHistory = append(e.SaltHistory[1:], e.Salt)
-		}
+	if err == nil {
 
-		// Store the new hash
+		// Store the new hash and keep the old one in the history
 
-		e.Passhash = string((&passhash)[:])
-		e.Salt = salt
+		e.setPasswordHash(ph, true)
 
 		err = ud.flush()
 	}
@@ -219,66 +262,97 @@ func (ud *UserDB) RemoveUserEntry(name string) error {
 }
 
 /*
-CheckUserPassword checks a given user password.
+CheckUserPassword checks a given user password. The password hash of the user
+is upgraded to the current algorithm and cost if the password is correct.
 */
 func (ud *UserDB) CheckUserPassword(name string, password string) bool {
 	ud.DataLock.RLock()
-	defer ud.DataLock.RUnlock()
 
 	// Check if the user exists - no specific error if the user does not exist!
 
 	e, ok := ud.Data[name]
 
+	// Unknown users are checked against a dummy hash so they take as long
+	// as known users
+
+	ph := dummyPasswordHash()
+
 	if ok {
+		ph = e.passwordHash()
+	}
 
-		// Generate passhash from given password
+	ud.DataLock.RUnlock()
 
-		passhash := sha256.Sum256(append(e.Salt, []byte(password)...))
+	// The password is hashed without holding the lock
 
-		// Compare the passhashes
+	ok = ph.matches(password) && ok
 
-		ok = stringutil.LengthConstantEquals((&passhash)[:], []byte(e.Passhash))
+	if ok && ph.outdated() {
+		ud.upgradePasswordHash(name, ph, password)
 	}
 
 	return ok
 }
 
+/*
+upgradePasswordHash replaces a given outdated password hash of a user with
+a hash of the current algorithm and cost. Nothing is done if the password
+was changed in the meantime. Errors are ignored since the old hash still
+works.
+*/
+func (ud *UserDB) upgradePasswordHash(name string, old *passwordHash, password string) {
+	newph, err := newPasswordHash(password)
+
+	if err != nil {
+		return
+	}
+
+	ud.DataLock.Lock()
+	defer ud.DataLock.Unlock()
+
+	if e, ok := ud.Data[name]; ok && e.Passhash == old.hash {
+		e.setPasswordHash(newph, false)
+		ud.flush()
+	}
+}
+
 /*
 CheckUserPasswordHistory checks if a given password is part of the password history.
 */
 func (ud *UserDB) CheckUserPasswordHistory(name string, password string) bool {
 	ud.DataLock.RLock()
-	defer ud.DataLock.RUnlock()
 
 	// Check if the user exists - no specific error if the user does not exist!
 
 	e, ok := ud.Data[name]
 
-	if ok {
+	history := []*passwordHash{dummyPasswordHash()}
 
-		ok = false
+	if ok {
+		history = make([]*passwordHash, len(e.PasshashHistory))
 
-		for i, histPasshash := range e.PasshashHistory {
-			histSalt := e.SaltHistory[i]
+		for i := range e.PasshashHistory {
+			history[i] = e.historyHash(i)
+		}
+	}
 
-			// Generate passhash from given password
+	ud.DataLock.RUnlock()
 
-			passhash := sha256.Sum256(append(histSalt, []byte(password)...))
+	// The passwords are hashed without holding the lock
 
-			// Compare the passhashes
+	for _, ph := range history {
 
-			ok = stringutil.LengthConstantEquals((&passhash)[:], []byte(histPasshash))
+		// Compare the passhashes
 
-			if ok {
+		if ph.matches(password) {
 
-				// Exit if we found a matching entry
+			// Exit if we found a matching entry
 
-				break
-			}
+			return ok
 		}
 	}
 
-	return ok
+	return false
 }
 
 /*
@@ -10,9 +10,13 @@
 package datautil
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"path"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUserDB(t *testing.T) {
@@ -288,6 +292,459 @@ func TestUserDBPasswordHistory(t *testing.T) {
 	}
 }
 
+func TestUserDBUnknownUser(t *testing.T) {
+	oldIterations := PBKDF2Iterations
+	defer func() {
+		PBKDF2Iterations = oldIterations
+	}()
+
+	PBKDF2Iterations = 100000
+
+	ud, err := NewUserDB(filepath.Join(t.TempDir(), "testuserdbunknown"), "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ud.AddUserEntry("fred", "s3cret", nil)
+
+	timeCheck := func(name string) time.Duration {
+		start := time.Now()
+		ud.CheckUserPassword(name, "foo")
+		ud.CheckUserPasswordHistory(name, "foo")
+		return time.Since(start)
+	}
+
+	// Checks of unknown users take about as long as checks of known users
+
+	known := timeCheck("fred")
+
+	if unknown := timeCheck("bob"); unknown < known/4 {
+		t.Error("Unexpected check time:", known, unknown)
+		return
+	}
+
+	if ud.CheckUserPassword("bob", "") || ud.CheckUserPasswordHistory("bob", "") {
+		t.Error("Unknown user should not match")
+		return
+	}
+}
+
+func TestUserDBPasswordHashUpgrade(t *testing.T) {
+	oldIterations := PBKDF2Iterations
+	defer func() {
+		PBKDF2Iterations = oldIterations
+	}()
+
+	legacyHash := func(salt []byte, password string) string {
+		hash := sha256.Sum256(append(append([]byte{}, salt...), []byte(password)...))
+		return string(hash[:])
+	}
+
+	filename := filepath.Join(t.TempDir(), "testuserdbupgrade")
+
+	ud, err := NewUserDB(filename, "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = ud.AddUserEntry("fred", "s3cret1", nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	e := ud.Data["fred"]
+
+	if e.Algorithm != PasswordHashPBKDF2 || e.Cost != PBKDF2Iterations {
+		t.Error("Unexpected result:", e.Algorithm, e.Cost)
+		return
+	}
+
+	// Simulate an entry which was written with the old hash
+
+	salt := []byte("salt")
+
+	e.Passhash = legacyHash(salt, "s3cret2")
+	e.Salt = salt
+	e.Algorithm = PasswordHashSHA256
+	e.Cost = 0
+	e.PasshashHistory = []string{legacyHash(salt, "s3cret1")}
+	e.SaltHistory = [][]byte{salt}
+	ud.flush()
+
+	ud, _ = NewUserDB(filename, "test123")
+
+	if !ud.CheckUserPasswordHistory("fred", "s3cret1") {
+		t.Error("Old history entry should still work")
+		return
+	}
+
+	// The hash is not upgraded on a failed check
+
+	if ud.CheckUserPassword("fred", "s3cret1") || ud.Data["fred"].Algorithm != PasswordHashSHA256 {
+		t.Error("Unexpected result:", ud.Data["fred"].Algorithm)
+		return
+	}
+
+	// The hash is upgraded on a successful check
+
+	if !ud.CheckUserPassword("fred", "s3cret2") || ud.Data["fred"].Algorithm != PasswordHashPBKDF2 {
+		t.Error("Unexpected result:", ud.Data["fred"].Algorithm)
+		return
+	}
+
+	ud, _ = NewUserDB(filename, "test123")
+	e = ud.Data["fred"]
+
+	if e.Algorithm != PasswordHashPBKDF2 || len(e.PasshashHistory) != 1 ||
+		!ud.CheckUserPassword("fred", "s3cret2") {
+		t.Error("Unexpected result:", e.Algorithm, e.PasshashHistory)
+		return
+	}
+
+	// Hashes with a lower cost are upgraded
+
+	PBKDF2Iterations = oldIterations + 1
+
+	if !ud.CheckUserPassword("fred", "s3cret2") || ud.Data["fred"].Cost != oldIterations+1 {
+		t.Error("Unexpected result:", ud.Data["fred"].Cost)
+		return
+	}
+
+	// Password history works across algorithms
+
+	if err = ud.UpdateUserPassword("fred", "s3cret3"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	e = ud.Data["fred"]
+
+	if fmt.Sprint(e.AlgorithmHistory, e.CostHistory) != fmt.Sprintf("[ pbkdf2-sha256] [0 %v]", oldIterations+1) {
+		t.Error("Unexpected result:", e.AlgorithmHistory, e.CostHistory)
+		return
+	}
+
+	if !ud.CheckUserPasswordHistory("fred", "s3cret1") || !ud.CheckUserPasswordHistory("fred", "s3cret2") ||
+		ud.CheckUserPasswordHistory("fred", "s3cret3") || !ud.CheckUserPassword("fred", "s3cret3") {
+		t.Error("Unexpected password history result")
+		return
+	}
+
+	// Unknown algorithms never match
+
+	e.Algorithm = "foo"
+
+	if ud.CheckUserPassword("fred", "s3cret3") {
+		t.Error("Unknown algorithm should not match")
+		return
+	}
+}
+
+func TestUserDBLockout(t *testing.T) {
+	ud, err := NewUserDB(path.Join(testdbdir, "testuserdblockout"), "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ud.AddUserEntry("fred", "s3cret", nil)
+	ud.AddUserEntry("john", "s3cret", nil)
+
+	ud.Throttle.Threshold = 3
+	ud.Throttle.LockoutTime = 50 * time.Millisecond
+	ud.Throttle.BaseDelay = 50 * time.Millisecond
+
+	if err := ud.CheckUserPasswordFrom("fred", "s3cret", "host1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ud.CheckUserPasswordFrom("fred", "foo", "host1"); err != ErrBadPassword {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Attempts directly after a failure are refused - even with the right password
+
+	if err := ud.CheckUserPasswordFrom("fred", "s3cret", "host2"); err != ErrThrottled {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// The source is throttled as well
+
+	if err := ud.CheckUserPasswordFrom("john", "s3cret", "host1"); err != ErrThrottled {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// The delay doubles with every failure
+
+	if err := ud.CheckUserPasswordFrom("fred", "foo", "host1"); err != ErrBadPassword {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := ud.CheckUserPasswordFrom("fred", "foo", "host2"); err != ErrThrottled ||
+		ud.Throttle.Failures("fred") != 2 {
+		t.Error("Unexpected result:", err, ud.Throttle.Failures("fred"))
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The user is locked after reaching the threshold
+
+	if err := ud.CheckUserPasswordFrom("fred", "foo", "host2"); err != ErrBadPassword {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := ud.CheckUserPasswordFrom("fred", "s3cret", "host3"); err != ErrLocked {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Unknown users are counted as well
+
+	if err := ud.CheckUserPasswordFrom("bob", "foo", ""); err != ErrBadPassword ||
+		ud.Throttle.Failures("bob") != 1 {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Unlock a user
+
+	ud.Throttle.UnlockUser("fred")
+
+	if err := ud.CheckUserPasswordFrom("fred", "s3cret", "host3"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The lockout ends after the lockout time
+
+	ud.Throttle.BaseDelay = 0
+
+	for i := 0; i < 3; i++ {
+		ud.CheckUserPasswordFrom("john", "foo", "host4")
+	}
+
+	if err := ud.CheckUserPasswordFrom("john", "s3cret", ""); err != ErrLocked {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	ud.Throttle.UnlockUser("john")
+
+	if err := ud.CheckUserPasswordFrom("john", "s3cret", "host4"); err != ErrLocked {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := ud.CheckUserPasswordFrom("john", "s3cret", "host4"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Failures start again after the lockout
+
+	ud.CheckUserPasswordFrom("john", "foo", "host4")
+
+	if res := ud.Throttle.Failures("john"); res != 1 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	ud.Throttle.UnlockSource("host4")
+
+	if err := ud.CheckUserPasswordFrom("john", "s3cret", "host4"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Failures are forgotten after the reset time
+
+	lt := NewLoginThrottle()
+	lt.BaseDelay = 0
+	lt.ResetAfter = 50 * time.Millisecond
+
+	lt.Check("fred", "")
+	lt.Failure("fred", "")
+
+	time.Sleep(60 * time.Millisecond)
+
+	if res := lt.Failures("fred"); res != 0 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Failures are kept without reset time until a lockout has ended
+
+	lt.ResetAfter = 0
+	lt.Threshold = 2
+	lt.LockoutTime = 50 * time.Millisecond
+
+	lt.Check("fred", "")
+	lt.Failure("fred", "")
+
+	time.Sleep(60 * time.Millisecond)
+
+	if res := lt.Failures("fred"); res != 1 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	lt.Check("fred", "")
+	lt.Failure("fred", "")
+
+	if err := lt.Check("fred", ""); err != ErrLocked || lt.Failures("fred") != 2 {
+		t.Error("Unexpected result:", err, lt.Failures("fred"))
+		return
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := lt.Check("fred", ""); err != nil || lt.Failures("fred") != 0 {
+		t.Error("Unexpected result:", err, lt.Failures("fred"))
+		return
+	}
+}
+
+func TestUserDBLockoutParallel(t *testing.T) {
+	ud, err := NewUserDB(filepath.Join(t.TempDir(), "testuserdblockoutparallel"), "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ud.AddUserEntry("fred", "s3cret", nil)
+
+	ud.Throttle.Threshold = 3
+	ud.Throttle.BaseDelay = 0
+
+	parallel := func(password string) map[error]int {
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+
+		results := make(map[error]int)
+
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				err := ud.CheckUserPasswordFrom("fred", password, "host1")
+
+				lock.Lock()
+				results[err]++
+				lock.Unlock()
+			}()
+		}
+
+		wg.Wait()
+
+		return results
+	}
+
+	// Parallel valid logins of a user without failures are not limited
+
+	if results := parallel("s3cret"); results[nil] != 50 {
+		t.Error("Unexpected result:", results)
+		return
+	}
+
+	// After a failure parallel guesses are evaluated one at a time so they
+	// cannot get more attempts evaluated than the threshold
+
+	ud.CheckUserPasswordFrom("fred", "foo", "host1")
+
+	results := parallel("foo")
+
+	if failures := ud.Throttle.Failures("fred"); failures < 2 || failures > 3 ||
+		results[ErrBadPassword] != failures-1 ||
+		results[ErrBadPassword]+results[ErrThrottled]+results[ErrLocked] != 50 {
+		t.Error("Unexpected result:", failures, results)
+		return
+	}
+
+	// Entries are not evicted before they expire
+
+	oldMaxEntries := MaxLoginThrottleEntries
+	defer func() {
+		MaxLoginThrottleEntries = oldMaxEntries
+	}()
+
+	MaxLoginThrottleEntries = 2
+
+	lt := NewLoginThrottle()
+	lt.Threshold = 1
+
+	lt.Check("john", "")
+	lt.Failure("john", "")
+	lt.Check("anne", "")
+	lt.Failure("anne", "")
+
+	if err := lt.Check("bob", ""); err != ErrThrottled {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := lt.Check("john", ""); err != ErrLocked {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	lt.UnlockUser("anne")
+
+	if err := lt.Check("bob", ""); err != nil {
+		t.Error(err)
+		return
+	}
+
+	lt.Success("bob", "")
+
+	// Only one attempt at a time is allowed after a failure
+
+	lt = NewLoginThrottle()
+	lt.BaseDelay = 0
+	lt.Check("bob", "")
+	lt.Failure("bob", "")
+
+	if err := lt.Check("bob", ""); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := lt.Check("bob", ""); err != ErrThrottled {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	// Successful attempts release the source
+
+	lt.Success("bob", "")
+
+	lt.Check("anne", "host3")
+	lt.Check("bob", "host3")
+	lt.Success("anne", "host3")
+	lt.Success("bob", "host3")
+
+	if _, ok := lt.sources.Get("host3"); ok || lt.Check("bob", "") != nil {
+		t.Error("Unexpected result:", lt.sources)
+		return
+	}
+}
+
 func TestUserDBErrorCases(t *testing.T) {
 
 	ud, err := NewUserDB(path.Join(testdbdir, invalidFileName), "test123")
@@ -0,0 +1,108 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/rhedin/Abe_common/stringutil"
+)
+
+/*
+Password hash algorithms of the user database
+*/
+const (
+	PasswordHashSHA256 = ""              // Single round of salted SHA-256 (only used by old entries)
+	PasswordHashPBKDF2 = "pbkdf2-sha256" // PBKDF2 with HMAC-SHA256
+)
+
+/*
+PBKDF2Iterations is the number of PBKDF2 iterations for new password hashes.
+Existing hashes with fewer iterations are upgraded on the next successful
+password check.
+*/
+var PBKDF2Iterations = 600000
+
+/*
+passwordHash is a password hash with all parameters which are needed to
+check a password against it.
+*/
+type passwordHash struct {
+	algorithm string // Hash algorithm
+	cost      int    // Cost parameter of the algorithm (e.g. iterations)
+	salt      []byte // Salt of the hash
+	hash      string // Hash of the password
+}
+
+/*
+newPasswordHash hashes a given password with a new salt and the current
+algorithm and cost.
+*/
+func newPasswordHash(password string) (*passwordHash, error) {
+	salt := make([]byte, sha256.Size)
+
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	ph := &passwordHash{PasswordHashPBKDF2, PBKDF2Iterations, salt, ""}
+
+	hash, err := ph.compute(password)
+	ph.hash = string(hash)
+
+	return ph, err
+}
+
+/*
+dummyPasswordHash returns a hash with the current algorithm and cost which
+matches no password. Checking a password against it takes as long as
+checking it against a real hash.
+*/
+func dummyPasswordHash() *passwordHash {
+	return &passwordHash{PasswordHashPBKDF2, PBKDF2Iterations, make([]byte, sha256.Size), ""}
+}
+
+/*
+compute hashes a given password with the parameters of this hash.
+*/
+func (ph *passwordHash) compute(password string) ([]byte, error) {
+	switch ph.algorithm {
+
+	case PasswordHashSHA256:
+		hash := sha256.Sum256(append(append([]byte{}, ph.salt...), []byte(password)...))
+		return hash[:], nil
+
+	case PasswordHashPBKDF2:
+		return pbkdf2.Key(sha256.New, password, ph.salt, ph.cost, sha256.Size)
+	}
+
+	return nil, fmt.Errorf("Unknown password hash algorithm: %v", ph.algorithm)
+}
+
+/*
+matches checks if a given password matches this hash.
+*/
+func (ph *passwordHash) matches(password string) bool {
+	hash, err := ph.compute(password)
+
+	return err == nil && stringutil.LengthConstantEquals(hash, []byte(ph.hash))
+}
+
+/*
+outdated returns if this hash should be replaced by a hash with the current
+algorithm and cost.
+*/
+func (ph *passwordHash) outdated() bool {
+	return ph.algorithm != PasswordHashPBKDF2 || ph.cost < PBKDF2Iterations
+}
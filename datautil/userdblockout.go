@@ -0,0 +1,329 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package datautil
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Login check errors
+*/
+var (
+	ErrBadPassword = errors.New("Unknown user or wrong password")
+	ErrThrottled   = errors.New("Too many failed login attempts - try again later")
+	ErrLocked      = errors.New("Account is locked")
+)
+
+/*
+MaxLoginThrottleEntries is the maximum number of users and of sources for
+which login attempts are remembered. Entries are only removed once they have
+expired so an active lockout cannot be flushed out by attempts with other
+names. While the maximum is reached attempts of users and sources which are
+not remembered are refused with ErrThrottled.
+*/
+var MaxLoginThrottleEntries uint64 = 10000
+
+/*
+LoginThrottle counts failed login attempts per user and per source (e.g. a
+remote address). After each failed attempt further attempts are refused for
+a delay which doubles with every failure. A user or source is locked for a
+while once the number of failed attempts reaches a threshold. Failures are
+forgotten after a period without failed attempts and when a lockout has
+ended.
+
+Each attempt which is allowed by Check must be settled with either Failure
+or Success. Once an attempt has failed only one attempt at a time is allowed
+until the failures are forgotten, so parallel attempts cannot be used to get
+around the delay or the threshold. Parallel attempts of users and sources
+without failures are not limited.
+
+The source is usually the remote address of a request. Note that behind a
+proxy all requests have the address of the proxy so all users share the
+failures of one source.
+*/
+type LoginThrottle struct {
+	Threshold   int           // Failed attempts after which a user or source is locked (0 for no lockout)
+	LockoutTime time.Duration // Time for which a user or source is locked
+	BaseDelay   time.Duration // Delay after the first failed attempt
+	MaxDelay    time.Duration // Maximum delay between failed attempts
+	ResetAfter  time.Duration // Time without failed attempts after which they are forgotten (0 to keep them)
+
+	users   *TypedMapCache[string, *loginAttempts] // Failed attempts per user
+	sources *TypedMapCache[string, *loginAttempts] // Failed attempts per source
+	lock    *sync.Mutex                            // Lock for the attempt counters
+}
+
+/*
+loginAttempts are the failed login attempts of a user or source.
+*/
+type loginAttempts struct {
+	failures    int       // Number of failed attempts
+	pending     int       // Number of allowed attempts which have not been settled
+	notBefore   time.Time // Time before which no new attempt is allowed
+	lockedUntil time.Time // Time until which the user or source is locked
+}
+
+/*
+NewLoginThrottle creates a new login throttle with default settings - a
+lockout of 15 minutes after 10 failed attempts and a delay starting at one
+second.
+*/
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{10, 15 * time.Minute, time.Second, time.Minute, time.Hour,
+		NewTypedMapCache[string, *loginAttempts](0, 0),
+		NewTypedMapCache[string, *loginAttempts](0, 0),
+		&sync.Mutex{}}
+}
+
+/*
+Check checks if a login attempt of a given user from a given source is
+allowed. Returns ErrLocked if the user or the source is locked and
+ErrThrottled if the attempt was made too soon after a failed attempt or
+while another attempt after a failure is pending. An allowed attempt is
+reserved until it is settled with Failure or Success. An empty source is not
+checked.
+*/
+func (lt *LoginThrottle) Check(name string, source string) error {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	now := time.Now()
+
+	err := lt.check(lt.users, name, now)
+
+	if err == nil && source != "" {
+		err = lt.check(lt.sources, source, now)
+	}
+
+	if err == nil {
+		lt.reserve(lt.users, name, now)
+
+		if source != "" {
+			lt.reserve(lt.sources, source, now)
+		}
+	}
+
+	return err
+}
+
+/*
+Failure records a failed login attempt of a given user from a given source.
+The attempt must have been allowed by Check.
+*/
+func (lt *LoginThrottle) Failure(name string, source string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	now := time.Now()
+
+	lt.failure(lt.users, name, now)
+
+	if source != "" {
+		lt.failure(lt.sources, source, now)
+	}
+}
+
+/*
+Success records a successful login of a given user from a given source. The
+attempt must have been allowed by Check. The failed attempts of the user are
+forgotten. Failed attempts of the source are kept so a valid login cannot be
+used to keep guessing the passwords of other users.
+*/
+func (lt *LoginThrottle) Success(name string, source string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	lt.users.Remove(name)
+
+	if source != "" {
+		lt.release(lt.sources, source)
+	}
+}
+
+/*
+Failures returns the number of remembered failed attempts of a given user.
+*/
+func (lt *LoginThrottle) Failures(name string) int {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	if a, ok := lt.users.Get(name); ok {
+		a.expire(time.Now())
+		return a.failures
+	}
+
+	return 0
+}
+
+/*
+UnlockUser removes the lock and all remembered failed attempts of a given user.
+*/
+func (lt *LoginThrottle) UnlockUser(name string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	lt.users.Remove(name)
+}
+
+/*
+UnlockSource removes the lock and all remembered failed attempts of a given
+source.
+*/
+func (lt *LoginThrottle) UnlockSource(source string) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+
+	lt.sources.Remove(source)
+}
+
+/*
+check checks the attempts of a given key. The caller must hold the lock.
+*/
+func (lt *LoginThrottle) check(attempts *TypedMapCache[string, *loginAttempts],
+	key string, now time.Time) error {
+
+	a, ok := attempts.Get(key)
+
+	if !ok {
+
+		// Entries are not evicted before they expire
+
+		if attempts.Size() >= MaxLoginThrottleEntries {
+			return ErrThrottled
+		}
+
+		return nil
+	}
+
+	a.expire(now)
+
+	if now.Before(a.lockedUntil) {
+		return ErrLocked
+	} else if now.Before(a.notBefore) || (a.failures > 0 && a.pending > 0) {
+		return ErrThrottled
+	}
+
+	return nil
+}
+
+/*
+reserve records an allowed attempt for a given key. The caller must hold the
+lock.
+*/
+func (lt *LoginThrottle) reserve(attempts *TypedMapCache[string, *loginAttempts],
+	key string, now time.Time) {
+
+	if a, ok := attempts.Get(key); ok {
+		a.pending++
+	} else {
+		attempts.PutWithTTL(key, &loginAttempts{0, 1, time.Time{}, time.Time{}}, lt.ResetAfter)
+	}
+}
+
+/*
+release settles a successful attempt for a given key. The caller must hold
+the lock.
+*/
+func (lt *LoginThrottle) release(attempts *TypedMapCache[string, *loginAttempts], key string) {
+	if a, ok := attempts.Get(key); ok {
+		if a.pending > 0 {
+			a.pending--
+		}
+
+		if a.failures == 0 && a.pending == 0 {
+			attempts.Remove(key)
+		}
+	}
+}
+
+/*
+failure records a failed attempt for a given key. The caller must hold the lock.
+*/
+func (lt *LoginThrottle) failure(attempts *TypedMapCache[string, *loginAttempts],
+	key string, now time.Time) {
+
+	a, ok := attempts.Get(key)
+
+	if !ok {
+		a = &loginAttempts{}
+	}
+
+	a.expire(now)
+
+	if a.pending > 0 {
+		a.pending--
+	}
+
+	a.failures++
+
+	if lt.Threshold > 0 && a.failures >= lt.Threshold {
+		a.lockedUntil = now.Add(lt.LockoutTime)
+
+	} else {
+		delay := lt.BaseDelay
+
+		for i := 1; i < a.failures && delay < lt.MaxDelay; i++ {
+			delay *= 2
+		}
+
+		if delay > lt.MaxDelay {
+			delay = lt.MaxDelay
+		}
+
+		a.notBefore = now.Add(delay)
+	}
+
+	// Keep the attempts at least as long as a lockout lasts
+
+	ttl := lt.ResetAfter
+
+	if locked := a.lockedUntil.Sub(now); ttl > 0 && locked > ttl {
+		ttl = locked
+	}
+
+	attempts.PutWithTTL(key, a, ttl)
+}
+
+/*
+expire forgets the failed attempts once a lockout has ended, so counting
+starts again.
+*/
+func (a *loginAttempts) expire(now time.Time) {
+	if !a.lockedUntil.IsZero() && !now.Before(a.lockedUntil) {
+		a.failures = 0
+		a.lockedUntil = time.Time{}
+	}
+}
+
+/*
+CheckUserPasswordFrom checks a given user password for a login attempt from
+a given source (e.g. a remote address). Failed attempts are counted by the
+login throttle of the database. Returns ErrBadPassword if the user does not
+exist or the password is wrong, ErrLocked if the user or source is locked
+and ErrThrottled if the attempt was made too soon after a failed attempt.
+The password is not checked if the attempt is refused.
+*/
+func (ud *UserDB) CheckUserPasswordFrom(name string, password string, source string) error {
+	if err := ud.Throttle.Check(name, source); err != nil {
+		return err
+	}
+
+	if !ud.CheckUserPassword(name, password) {
+		ud.Throttle.Failure(name, source)
+		return ErrBadPassword
+	}
+
+	ud.Throttle.Success(name, source)
+
+	return nil
+}
@@ -16,10 +16,19 @@ See: https://en.wikipedia.org/wiki/Basic_access_authentication
 
 Cookie based authentication requires the client to login once and create a unique
 access token. The access token is then used to authenticate each request.
+
+Both wrappers can use an authentication function which returns the reason of a
+failed login (e.g. datautil.UserDB.CheckUserPasswordFrom) so failed attempts
+can be throttled per user and per remote address.
 */
 package auth
 
-import "net/http"
+import (
+	"net"
+	"net/http"
+
+	"github.com/rhedin/Abe_common/datautil"
+)
 
 /*
 HandleFuncWrapper is an abstract wrapper for handle functions to add authentication features.
@@ -32,6 +41,13 @@ type HandleFuncWrapper interface {
 	*/
 	SetAuthFunc(authFunc func(user, pass string) bool)
 
+	/*
+		SetAuthErrFunc gives an authentication function which also gets the
+		source of the request and returns the reason of a failed authentication.
+		It is used instead of the function given by SetAuthFunc.
+	*/
+	SetAuthErrFunc(authErrFunc func(user, pass, source string) error)
+
 	/*
 	   HandleFunc is the new handle func which wraps an original handle functions to do an authentication check.
 	*/
@@ -43,3 +59,44 @@ type HandleFuncWrapper interface {
 	*/
 	CheckAuth(r *http.Request) (string, bool)
 }
+
+/*
+SourceFunc returns the source of a request which is used to throttle failed
+login attempts. The default is RequestSource. Behind a reverse proxy all
+requests have the address of the proxy so all users would share the failed
+attempts of one source. A function which reads the client address from a
+header of a trusted proxy (e.g. X-Forwarded-For) can be set instead.
+*/
+var SourceFunc = RequestSource
+
+/*
+RequestSource returns the remote address of a request without port.
+*/
+func RequestSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+/*
+checkCredentials checks given credentials with the given authentication
+functions. Returns datautil.ErrBadPassword if no function is given or the
+credentials are wrong.
+*/
+func checkCredentials(authFunc func(user, pass string) bool,
+	authErrFunc func(user, pass, source string) error, user, pass, source string) error {
+
+	if authErrFunc != nil {
+		return authErrFunc(user, pass, source)
+	}
+
+	if authFunc != nil && authFunc(user, pass) {
+		return nil
+	}
+
+	return datautil.ErrBadPassword
+}
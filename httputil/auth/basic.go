@@ -14,7 +14,9 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/rhedin/Abe_common/datautil"
 	"github.com/rhedin/Abe_common/httputil/user"
+	"github.com/rhedin/Abe_common/logutil"
 )
 
 /*
@@ -29,12 +31,14 @@ basic authentication to all added endpoints.
 type BashicAuthHandleFuncWrapper struct {
 	origHandleFunc func(pattern string, handler func(http.ResponseWriter, *http.Request))
 	authFunc       func(user, pass string) bool
+	authErrFunc    func(user, pass, source string) error
 	accessFunc     func(http.ResponseWriter, *http.Request, string) bool
 
 	// Callbacks
 
 	CallbackSessionExpired func(w http.ResponseWriter, r *http.Request)
 	CallbackUnauthorized   func(w http.ResponseWriter, r *http.Request)
+	CallbackLocked         func(w http.ResponseWriter, r *http.Request)
 }
 
 /*
@@ -47,6 +51,7 @@ func NewBashicAuthHandleFuncWrapper(origHandleFunc func(pattern string,
 		origHandleFunc,
 		nil,
 		nil,
+		nil,
 
 		// Session expired callback
 
@@ -60,6 +65,13 @@ func NewBashicAuthHandleFuncWrapper(origHandleFunc func(pattern string,
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized\n"))
 		},
+
+		// Locked callback
+
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("Too many failed login attempts\n"))
+		},
 	}
 }
 
@@ -71,6 +83,16 @@ func (bw *BashicAuthHandleFuncWrapper) SetAuthFunc(authFunc func(user, pass stri
 	bw.authFunc = authFunc
 }
 
+/*
+SetAuthErrFunc gives an authentication function which also gets the source of
+the request and returns the reason of a failed authentication. It is used
+instead of the function given by SetAuthFunc. CallbackLocked is called if
+the function returns datautil.ErrLocked or datautil.ErrThrottled.
+*/
+func (bw *BashicAuthHandleFuncWrapper) SetAuthErrFunc(authErrFunc func(user, pass, source string) error) {
+	bw.authErrFunc = authErrFunc
+}
+
 /*
 SetAccessFunc sets an access function which can be used by the wrapper to
 check the user access rights.
@@ -86,7 +108,9 @@ func (bw *BashicAuthHandleFuncWrapper) HandleFunc(pattern string, handler func(h
 
 	bw.origHandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
 
-		if name, res := bw.CheckAuth(r); res {
+		name, err := bw.CheckAuthErr(r)
+
+		if err == nil {
 
 			session, err := user.UserSessionManager.GetSession(name, w, r, true)
 
@@ -98,7 +122,8 @@ func (bw *BashicAuthHandleFuncWrapper) HandleFunc(pattern string, handler func(h
 
 					// Handle the request
 
-					handler(w, r)
+					handler(w, r.WithContext(logutil.ContextWithFields(r.Context(),
+						"user", name, "session", session.ID())))
 				}
 
 				return
@@ -106,6 +131,12 @@ func (bw *BashicAuthHandleFuncWrapper) HandleFunc(pattern string, handler func(h
 
 			bw.CallbackSessionExpired(w, r)
 
+			return
+
+		} else if err == datautil.ErrLocked || err == datautil.ErrThrottled {
+
+			bw.CallbackLocked(w, r)
+
 			return
 		}
 
@@ -118,22 +149,32 @@ CheckAuth checks the user authentication of an incomming request. Returns
 if the authentication is correct and the given username.
 */
 func (bw *BashicAuthHandleFuncWrapper) CheckAuth(r *http.Request) (string, bool) {
+	user, err := bw.CheckAuthErr(r)
+	return user, err == nil
+}
+
+/*
+CheckAuthErr checks the user authentication of an incomming request. Returns
+the given username and the reason if the authentication is not correct.
+*/
+func (bw *BashicAuthHandleFuncWrapper) CheckAuthErr(r *http.Request) (string, error) {
 	var user string
-	var ok bool
+
+	err := datautil.ErrBadPassword
 
 	if s := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(s) == 2 {
 
-		if b, err := base64.StdEncoding.DecodeString(s[1]); err == nil {
+		if b, derr := base64.StdEncoding.DecodeString(s[1]); derr == nil {
 
 			if pair := strings.Split(string(b), ":"); len(pair) == 2 {
 
 				user = pair[0]
 				pass := pair[1]
 
-				ok = bw.authFunc != nil && bw.authFunc(user, pass)
+				err = checkCredentials(bw.authFunc, bw.authErrFunc, user, pass, SourceFunc(r))
 			}
 		}
 	}
 
-	return user, ok
+	return user, err
 }
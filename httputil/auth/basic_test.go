@@ -4,10 +4,13 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/rhedin/Abe_common/datautil"
 	"github.com/rhedin/Abe_common/httputil/user"
 )
 
@@ -220,3 +223,131 @@ func TestBasicAuth(t *testing.T) {
 		return
 	}
 }
+
+func TestBasicAuthLockout(t *testing.T) {
+	oldIterations := datautil.PBKDF2Iterations
+	datautil.PBKDF2Iterations = 1000
+	defer func() {
+		datautil.PBKDF2Iterations = oldIterations
+	}()
+
+	ud, err := datautil.NewUserDB(filepath.Join(t.TempDir(), "userdb"), "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ud.AddUserEntry("yams", "yams", nil)
+
+	ud.Throttle.Threshold = 2
+	ud.Throttle.BaseDelay = 0
+
+	var handler func(http.ResponseWriter, *http.Request)
+
+	ba := NewBashicAuthHandleFuncWrapper(func(pattern string,
+		h func(http.ResponseWriter, *http.Request)) {
+		handler = h
+	})
+
+	ba.SetAuthErrFunc(ud.CheckUserPasswordFrom)
+
+	ba.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Content\n"))
+	})
+
+	request := func(pass string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte("yams:"+pass)))
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		return fmt.Sprint(w.Code, " ", strings.TrimSpace(w.Body.String()))
+	}
+
+	if res := request("yams"); res != "200 Content" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := request("foo"); res != "401 Unauthorized" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	request("foo")
+
+	if res := request("yams"); res != "429 Too many failed login attempts" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if name, err := ba.CheckAuthErr(httptest.NewRequest("GET", "/", nil)); name != "" || err != datautil.ErrBadPassword {
+		t.Error("Unexpected result:", name, err)
+		return
+	}
+
+	// Unlock the user and the source
+
+	ud.Throttle.UnlockUser("yams")
+	ud.Throttle.UnlockSource("192.0.2.1")
+
+	if res := request("yams"); res != "200 Content" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if res := RequestSource(r); res != "192.0.2.1" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	r.RemoteAddr = "foo"
+
+	if res := RequestSource(r); res != "foo" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// The source can be taken from a proxy header instead
+
+	defer func() {
+		SourceFunc = RequestSource
+	}()
+
+	SourceFunc = func(r *http.Request) string {
+		return r.Header.Get("X-Forwarded-For")
+	}
+
+	forwardedRequest := func(pass string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("yams", pass)
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		return fmt.Sprint(w.Code, " ", strings.TrimSpace(w.Body.String()))
+	}
+
+	forwardedRequest("foo")
+	forwardedRequest("foo")
+
+	ud.Throttle.UnlockUser("yams")
+	ud.Throttle.UnlockSource("192.0.2.1")
+
+	if res := forwardedRequest("yams"); res != "429 Too many failed login attempts" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	ud.Throttle.UnlockSource("198.51.100.1")
+
+	if res := forwardedRequest("yams"); res != "200 Content" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/rhedin/Abe_common/datautil"
 	"github.com/rhedin/Abe_common/errorutil"
 	"github.com/rhedin/Abe_common/httputil/user"
+	"github.com/rhedin/Abe_common/logutil"
 )
 
 /*
@@ -45,8 +46,10 @@ cookie authentication to all added endpoints.
 type CookieAuthHandleFuncWrapper struct {
 	origHandleFunc func(pattern string, handler func(http.ResponseWriter, *http.Request))
 	authFunc       func(user, pass string) bool
+	authErrFunc    func(user, pass, source string) error
 	accessFunc     func(http.ResponseWriter, *http.Request, string) bool
 	tokenMap       *datautil.MapCache
+	tokenEvict     func(token string, user string, reason datautil.EvictionReason)
 	expiry         int
 	publicURL      map[string]func(http.ResponseWriter, *http.Request)
 
@@ -66,7 +69,9 @@ func NewCookieAuthHandleFuncWrapper(origHandleFunc func(pattern string,
 		origHandleFunc,
 		nil,
 		nil,
+		nil,
 		datautil.NewMapCache(0, int64(CookieMaxLifetime)),
+		nil,
 		CookieMaxLifetime,
 		make(map[string]func(http.ResponseWriter, *http.Request)),
 
@@ -105,6 +110,37 @@ are retracted during this function call.
 func (cw *CookieAuthHandleFuncWrapper) SetExpiry(secs int) {
 	cw.expiry = secs
 	cw.tokenMap = datautil.NewMapCache(0, int64(secs))
+	cw.tokenMap.SetOnEvict(cw.onTokenEvict)
+}
+
+/*
+SetTokenEvictHandler sets a handler which is called for every auth token which
+is no longer valid. The reason is EvictionExpired for tokens which have timed
+out and EvictionRemoved for tokens which were invalidated.
+*/
+func (cw *CookieAuthHandleFuncWrapper) SetTokenEvictHandler(handler func(token string,
+	user string, reason datautil.EvictionReason)) {
+
+	cw.tokenEvict = handler
+	cw.tokenMap.SetOnEvict(cw.onTokenEvict)
+}
+
+/*
+TokenStats returns statistics of the auth token map.
+*/
+func (cw *CookieAuthHandleFuncWrapper) TokenStats() datautil.MapCacheStats {
+	return cw.tokenMap.Stats()
+}
+
+/*
+onTokenEvict is the eviction callback of the auth token map.
+*/
+func (cw *CookieAuthHandleFuncWrapper) onTokenEvict(key string, value interface{},
+	reason datautil.EvictionReason) {
+
+	if cw.tokenEvict != nil {
+		cw.tokenEvict(key, fmt.Sprint(value), reason)
+	}
 }
 
 /*
@@ -115,6 +151,15 @@ func (cw *CookieAuthHandleFuncWrapper) SetAuthFunc(authFunc func(user, pass stri
 	cw.authFunc = authFunc
 }
 
+/*
+SetAuthErrFunc sets an authentication function which also gets the source of
+the login request and returns the reason of a failed authentication. It is
+used instead of the function given by SetAuthFunc.
+*/
+func (cw *CookieAuthHandleFuncWrapper) SetAuthErrFunc(authErrFunc func(user, pass, source string) error) {
+	cw.authErrFunc = authErrFunc
+}
+
 /*
 SetAccessFunc sets an access function which can be used by the wrapper to
 check the user access rights.
@@ -128,8 +173,20 @@ AuthUser authenticates a user and creates an auth token unless testOnly is true.
 Returns an empty string if the authentication was not successful.
 */
 func (cw *CookieAuthHandleFuncWrapper) AuthUser(user, pass string, testOnly bool) string {
+	aid, _ := cw.AuthUserFrom(user, pass, "", testOnly)
+	return aid
+}
+
+/*
+AuthUserFrom authenticates a user who tries to login from a given source (see
+SourceFunc) and creates an auth token unless testOnly is true. Returns the
+reason if the authentication was not successful (e.g. datautil.ErrLocked).
+*/
+func (cw *CookieAuthHandleFuncWrapper) AuthUserFrom(user, pass, source string, testOnly bool) (string, error) {
+
+	err := checkCredentials(cw.authFunc, cw.authErrFunc, user, pass, source)
 
-	if cw.authFunc != nil && cw.authFunc(user, pass) {
+	if err == nil {
 
 		if !testOnly {
 
@@ -139,13 +196,13 @@ func (cw *CookieAuthHandleFuncWrapper) AuthUser(user, pass string, testOnly bool
 
 			cw.tokenMap.Put(aid, user)
 
-			return aid
+			return aid, nil
 		}
 
-		return "ok"
+		return "ok", nil
 	}
 
-	return ""
+	return "", err
 }
 
 /*
@@ -285,7 +342,8 @@ func (cw *CookieAuthHandleFuncWrapper) HandleFunc(pattern string, handler func(h
 						// Handle the request
 
 						abelog.UnderPrintf("\n")
-						handler(w, r)
+						handler(w, r.WithContext(logutil.ContextWithFields(r.Context(),
+							"user", nameString, "session", session.ID())))
 					}
 
 					return
@@ -3,9 +3,11 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/rhedin/Abe_common/datautil"
 	"github.com/rhedin/Abe_common/httputil"
 	"github.com/rhedin/Abe_common/httputil/user"
 )
@@ -241,3 +243,122 @@ func TestCookieAuth(t *testing.T) {
 	}
 
 }
+
+func TestCookieAuthTokenEviction(t *testing.T) {
+	ca := NewCookieAuthHandleFuncWrapper(func(pattern string,
+		handler func(http.ResponseWriter, *http.Request)) {
+	})
+
+	ca.SetAuthFunc(func(user, pass string) bool {
+		return true
+	})
+
+	var evicted []string
+
+	ca.SetTokenEvictHandler(func(token string, user string, reason datautil.EvictionReason) {
+		evicted = append(evicted, fmt.Sprint(user, ":", reason))
+	})
+
+	aid := ca.AuthUser("yams", "yams", false)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookieNameAuth, Value: aid})
+
+	if name, ok := ca.CheckAuth(r); !ok || name != "yams" {
+		t.Error("Unexpected result:", name, ok)
+		return
+	}
+
+	ca.InvalidateAuthCookie(r)
+
+	if _, ok := ca.CheckAuth(r); ok {
+		t.Error("Token should no longer be valid")
+		return
+	}
+
+	// The handler is kept when the expiry is changed
+
+	ca.SetExpiry(42)
+	ca.AuthUser("foo", "foo", false)
+	ca.SetExpiry(0)
+
+	ca.AuthUser("bar", "bar", false)
+	ca.tokenMap.Clear()
+
+	if fmt.Sprint(evicted) != "[yams:removed bar:cleared]" {
+		t.Error("Unexpected evictions:", evicted)
+		return
+	}
+
+	if stats := ca.TokenStats(); stats.Hits != 0 || stats.Misses != 0 ||
+		stats.Evictions[datautil.EvictionCleared] != 1 {
+		t.Error("Unexpected stats:", stats)
+		return
+	}
+}
+
+func TestCookieAuthLockout(t *testing.T) {
+	oldIterations := datautil.PBKDF2Iterations
+	datautil.PBKDF2Iterations = 1000
+	defer func() {
+		datautil.PBKDF2Iterations = oldIterations
+	}()
+
+	ud, err := datautil.NewUserDB(filepath.Join(t.TempDir(), "userdb"), "test123")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ud.AddUserEntry("yams", "yams", nil)
+
+	ud.Throttle.Threshold = 2
+	ud.Throttle.BaseDelay = 0
+
+	ca := NewCookieAuthHandleFuncWrapper(func(pattern string,
+		handler func(http.ResponseWriter, *http.Request)) {
+	})
+
+	if aid, err := ca.AuthUserFrom("yams", "yams", "host1", false); aid != "" || err != datautil.ErrBadPassword {
+		t.Error("Unexpected result:", aid, err)
+		return
+	}
+
+	ca.SetAuthErrFunc(ud.CheckUserPasswordFrom)
+
+	if aid, err := ca.AuthUserFrom("yams", "yams", "host1", true); aid != "ok" || err != nil {
+		t.Error("Unexpected result:", aid, err)
+		return
+	}
+
+	if aid, err := ca.AuthUserFrom("yams", "foo", "host1", false); aid != "" || err != datautil.ErrBadPassword {
+		t.Error("Unexpected result:", aid, err)
+		return
+	}
+
+	ca.AuthUserFrom("yams", "foo", "host2", false)
+
+	if aid, err := ca.AuthUserFrom("yams", "yams", "host3", false); aid != "" || err != datautil.ErrLocked {
+		t.Error("Unexpected result:", aid, err)
+		return
+	}
+
+	if aid := ca.AuthUser("yams", "yams", false); aid != "" {
+		t.Error("Unexpected result:", aid)
+		return
+	}
+
+	ud.Throttle.UnlockUser("yams")
+
+	aid, err := ca.AuthUserFrom("yams", "yams", "host3", false)
+
+	if !strings.HasPrefix(aid, "A-") || err != nil {
+		t.Error("Unexpected result:", aid, err)
+		return
+	}
+
+	if name, _ := ca.tokenMap.Get(aid); name != "yams" {
+		t.Error("Unexpected result:", name)
+		return
+	}
+}
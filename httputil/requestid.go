@@ -0,0 +1,63 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package httputil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rhedin/Abe_common/cryptutil"
+	"github.com/rhedin/Abe_common/logutil"
+)
+
+/*
+RequestIDHeader is the response header which carries the request id.
+*/
+const RequestIDHeader = "X-Request-Id"
+
+/*
+RequestIDLogKey is the log field key which holds the request id.
+*/
+const RequestIDLogKey = "requestid"
+
+/*
+requestIDContextKey is the context key which holds the request id.
+*/
+type requestIDContextKey struct{}
+
+/*
+RequestIDHandler returns a handler which generates a unique id for every
+request before calling a given handler. The id is stored in the request
+context as a log field (see logutil.FromContext) and returned in the
+response header RequestIDHeader.
+*/
+func RequestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := cryptutil.GenerateUUID()
+		id := fmt.Sprintf("%x", uuid[:])
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		ctx = logutil.ContextWithFields(ctx, RequestIDLogKey, id)
+
+		w.Header().Set(RequestIDHeader, id)
+
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+/*
+RequestID returns the request id of a given request. Returns an empty string
+if the request was not handled by a RequestIDHandler.
+*/
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
@@ -0,0 +1,64 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package httputil
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rhedin/Abe_common/logutil"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	logutil.ClearLogSinks()
+	defer logutil.ClearLogSinks()
+
+	buf := &bytes.Buffer{}
+
+	logutil.GetLogger("").AddLogSink(logutil.Debug, logutil.TemplateFormatter("%m %k"), buf)
+
+	var id string
+
+	handler := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestID(r)
+		logutil.FromContext(r.Context(), "foo").Info("test")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if len(id) != 32 || rec.Header().Get(RequestIDHeader) != id {
+		t.Error("Unexpected request id:", id, rec.Header())
+		return
+	}
+
+	if buf.String() != "test requestid="+id+"\n" {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Each request gets a new id
+
+	oldID := id
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if id == oldID {
+		t.Error("Request id should be unique")
+		return
+	}
+
+	if res := RequestID(httptest.NewRequest("GET", "/", nil)); res != "" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+AsyncPolicy determines what an AsyncWriter does if its queue is full.
+*/
+type AsyncPolicy int
+
+/*
+Async policies
+*/
+const (
+	AsyncBlock      AsyncPolicy = iota // Wait until there is space in the queue
+	AsyncDropNewest                    // Drop the new message
+	AsyncDropOldest                    // Drop the oldest queued message
+	AsyncSample                        // Keep every n-th new message (see SetSampleRate) dropping the oldest and drop the rest
+)
+
+/*
+ErrAsyncWriterClosed is returned when writing to a closed AsyncWriter.
+*/
+var ErrAsyncWriterClosed = errors.New("AsyncWriter is closed")
+
+/*
+AsyncWriter is an io.Writer which queues all written data and writes it to
+an underlying appender in a separate goroutine. An AsyncWriter can be given
+to AddLogSink so slow appenders do not stall the logging code.
+*/
+type AsyncWriter struct {
+	appender   io.Writer        // Underlying appender
+	queue      chan *asyncEntry // Queue of pending writes
+	policy     AsyncPolicy      // Policy when the queue is full
+	dropped    uint64           // Number of dropped writes
+	overflows  uint64           // Number of writes which hit a full queue
+	closed     bool             // Flag if the writer was closed
+	closedLock *sync.RWMutex    // Lock for the closed flag
+	finished   chan struct{}    // Channel which is closed once the writer goroutine has ended
+	sampleRate uint64           // Rate of messages which are kept with the AsyncSample policy
+	markers    []chan struct{}  // Flush markers which were dropped from the queue
+	markerLock *sync.Mutex      // Lock for dropped flush markers
+}
+
+/*
+asyncEntry is a single entry in the queue of an AsyncWriter. An entry is either
+data or a flush marker.
+*/
+type asyncEntry struct {
+	data []byte        // Data to write
+	done chan struct{} // Channel which is closed once the marker was reached
+}
+
+/*
+NewAsyncWriter creates a new AsyncWriter with a queue of a given size.
+*/
+func NewAsyncWriter(appender io.Writer, size int, policy AsyncPolicy) *AsyncWriter {
+	aw := &AsyncWriter{appender, make(chan *asyncEntry, size), policy, 0, 0,
+		false, &sync.RWMutex{}, make(chan struct{}), 10, nil, &sync.Mutex{}}
+
+	go aw.run()
+
+	return aw
+}
+
+/*
+Write queues the given data. The data is accepted but discarded if it was
+dropped due to the policy of the writer.
+*/
+func (aw *AsyncWriter) Write(p []byte) (int, error) {
+	aw.closedLock.RLock()
+	defer aw.closedLock.RUnlock()
+
+	if aw.closed {
+		return 0, ErrAsyncWriterClosed
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	entry := &asyncEntry{data, nil}
+
+	select {
+	case aw.queue <- entry:
+		return len(p), nil
+	default:
+	}
+
+	// The queue is full
+
+	overflows := atomic.AddUint64(&aw.overflows, 1)
+
+	switch aw.policy {
+
+	case AsyncDropNewest:
+		atomic.AddUint64(&aw.dropped, 1)
+		return len(p), nil
+
+	case AsyncSample:
+		if rate := atomic.LoadUint64(&aw.sampleRate); rate > 1 && overflows%rate != 0 {
+			atomic.AddUint64(&aw.dropped, 1)
+			return len(p), nil
+		}
+		aw.enqueueDropOldest(entry)
+
+	case AsyncDropOldest:
+		aw.enqueueDropOldest(entry)
+
+	default:
+		aw.queue <- entry
+	}
+
+	return len(p), nil
+}
+
+/*
+enqueueDropOldest adds an entry to the queue and removes old entries until
+there is enough space.
+*/
+func (aw *AsyncWriter) enqueueDropOldest(entry *asyncEntry) {
+	for {
+		select {
+		case aw.queue <- entry:
+			return
+		default:
+		}
+
+		select {
+		case old := <-aw.queue:
+			if old.done != nil {
+
+				// The writer goroutine may still be writing data from before
+				// the flush marker - it signals the marker once it is done
+
+				aw.markerLock.Lock()
+				aw.markers = append(aw.markers, old.done)
+				aw.markerLock.Unlock()
+
+			} else {
+
+				atomic.AddUint64(&aw.dropped, 1)
+			}
+		default:
+		}
+	}
+}
+
+/*
+SetSampleRate sets the rate of messages which are kept with the AsyncSample
+policy once the queue is full, e.g. every 10th message for a rate of 10
+(default).
+*/
+func (aw *AsyncWriter) SetSampleRate(rate uint64) {
+	atomic.StoreUint64(&aw.sampleRate, rate)
+}
+
+/*
+Dropped returns the number of dropped writes.
+*/
+func (aw *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&aw.dropped)
+}
+
+/*
+Flush waits until all data which was queued before this call was written.
+*/
+func (aw *AsyncWriter) Flush() error {
+	aw.closedLock.RLock()
+
+	if aw.closed {
+		aw.closedLock.RUnlock()
+		return ErrAsyncWriterClosed
+	}
+
+	done := make(chan struct{})
+
+	aw.queue <- &asyncEntry{nil, done}
+
+	aw.closedLock.RUnlock()
+
+	<-done
+
+	return nil
+}
+
+/*
+Close writes all remaining data and stops the writer. The underlying appender
+is not closed.
+*/
+func (aw *AsyncWriter) Close() error {
+	aw.closedLock.Lock()
+
+	if aw.closed {
+		aw.closedLock.Unlock()
+		return ErrAsyncWriterClosed
+	}
+
+	aw.closed = true
+	close(aw.queue)
+
+	aw.closedLock.Unlock()
+
+	<-aw.finished
+
+	return nil
+}
+
+/*
+run writes all queued data to the underlying appender.
+*/
+func (aw *AsyncWriter) run() {
+	for entry := range aw.queue {
+
+		if entry.done != nil {
+			close(entry.done)
+
+		} else if _, err := aw.appender.Write(entry.data); err != nil {
+
+			// Something went wrong use the fallback logger
+
+			fallbackLogger(fmt.Sprintf(
+				"Could not publish log message: %v (message: %v)",
+				err, string(entry.data)))
+		}
+
+		aw.releaseMarkers()
+	}
+
+	aw.releaseMarkers()
+
+	close(aw.finished)
+}
+
+/*
+releaseMarkers signals all flush markers which were dropped from the queue.
+The markers were dropped after the current entry was taken from the queue so
+all data before them has been handled.
+*/
+func (aw *AsyncWriter) releaseMarkers() {
+	aw.markerLock.Lock()
+	defer aw.markerLock.Unlock()
+
+	for _, done := range aw.markers {
+		close(done)
+	}
+
+	aw.markers = nil
+}
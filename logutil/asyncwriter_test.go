@@ -0,0 +1,239 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+blockingWriter is a writer which blocks until it is released.
+*/
+type blockingWriter struct {
+	buf     bytes.Buffer
+	lock    sync.Mutex
+	release chan struct{}
+	started chan struct{}
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{release: make(chan struct{}), started: make(chan struct{}, 100)}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	bw.started <- struct{}{}
+	<-bw.release
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return bw.buf.Write(p)
+}
+
+func (bw *blockingWriter) String() string {
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return bw.buf.String()
+}
+
+func TestAsyncWriter(t *testing.T) {
+	ClearLogSinks()
+
+	buf := &bytes.Buffer{}
+	aw := NewAsyncWriter(buf, 10, AsyncBlock)
+
+	logger := GetLogger("foo")
+	logger.AddLogSink(Debug, ConsoleFormatter(), aw)
+
+	logger.Info("test1")
+	logger.Warning("test2")
+
+	if err := aw.Flush(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if buf.String() != "Info: test1\nWarning: test2\n" {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	logger.Info("test3")
+
+	if err := aw.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if buf.String() != "Info: test1\nWarning: test2\nInfo: test3\n" || aw.Dropped() != 0 {
+		t.Error("Unexpected output:", buf.String(), aw.Dropped())
+		return
+	}
+
+	// Test error cases
+
+	if _, err := aw.Write([]byte("test")); err != ErrAsyncWriterClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := aw.Flush(); err != ErrAsyncWriterClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := aw.Close(); err != ErrAsyncWriterClosed {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	fallbackBuf := &bytes.Buffer{}
+	fallbackLogger = func(v ...interface{}) {
+		fallbackBuf.WriteString(fmt.Sprint(v...))
+	}
+
+	aw = NewAsyncWriter(&brokenSink{}, 10, AsyncBlock)
+	aw.Write([]byte("test"))
+	aw.Close()
+
+	if !strings.Contains(fallbackBuf.String(), "testerror") {
+		t.Error("Unexpected output:", fallbackBuf.String())
+		return
+	}
+
+	ClearLogSinks()
+}
+
+func TestAsyncWriterPolicies(t *testing.T) {
+
+	// fill writes a number of messages into a writer with a queue size of 2
+	// while the appender is blocked by the first message
+
+	fill := func(policy AsyncPolicy, n int) (*AsyncWriter, *blockingWriter) {
+		bw := newBlockingWriter()
+		aw := NewAsyncWriter(bw, 2, policy)
+		aw.SetSampleRate(3)
+
+		aw.Write([]byte("0"))
+		<-bw.started
+
+		for i := 1; i <= n; i++ {
+			aw.Write([]byte(fmt.Sprint(i)))
+		}
+
+		return aw, bw
+	}
+
+	aw, bw := fill(AsyncDropNewest, 5)
+	close(bw.release)
+	aw.Close()
+
+	if res := bw.String(); res != "012" || aw.Dropped() != 3 {
+		t.Error("Unexpected result:", res, aw.Dropped())
+		return
+	}
+
+	aw, bw = fill(AsyncDropOldest, 5)
+	close(bw.release)
+	aw.Close()
+
+	if res := bw.String(); res != "045" || aw.Dropped() != 3 {
+		t.Error("Unexpected result:", res, aw.Dropped())
+		return
+	}
+
+	// Overflows 1, 2, 4, 5 are dropped, overflow 3 (message 5) replaces message 1
+
+	aw, bw = fill(AsyncSample, 7)
+	close(bw.release)
+	aw.Close()
+
+	if res := bw.String(); res != "025" || aw.Dropped() != 5 {
+		t.Error("Unexpected result:", res, aw.Dropped())
+		return
+	}
+
+	// A dropped flush marker waits for the data which is being written
+
+	bw = newBlockingWriter()
+	aw = NewAsyncWriter(bw, 2, AsyncDropOldest)
+
+	aw.Write([]byte("0"))
+	<-bw.started
+
+	flushed := make(chan string)
+
+	go func() {
+		aw.Flush()
+		flushed <- bw.String()
+	}()
+
+	for len(aw.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	aw.Write([]byte("1"))
+	aw.Write([]byte("2"))
+
+	select {
+	case res := <-flushed:
+		t.Error("Flush returned early:", res)
+		return
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(bw.release)
+
+	if res := <-flushed; !strings.HasPrefix(res, "0") {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	aw.Close()
+
+	if res := bw.String(); res != "012" || aw.Dropped() != 0 {
+		t.Error("Unexpected result:", res, aw.Dropped())
+		return
+	}
+
+	// Blocking policy loses nothing
+
+	bw = newBlockingWriter()
+	aw = NewAsyncWriter(bw, 2, AsyncBlock)
+
+	go func() {
+		for range bw.started {
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			aw.Write([]byte(fmt.Sprint(i)))
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(bw.release)
+
+	wg.Wait()
+	aw.Close()
+
+	if res := bw.String(); res != "01234" || aw.Dropped() != 0 {
+		t.Error("Unexpected result:", res, aw.Dropped())
+		return
+	}
+}
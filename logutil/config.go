@@ -0,0 +1,293 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rhedin/Abe_common/fileutil"
+)
+
+/*
+LogConfigKey is the config key which holds the list of log sinks.
+*/
+const LogConfigKey = "LogSinks"
+
+/*
+ApplyLogConfig configures log sinks from a config map as returned by
+fileutil.LoadConfig or WatchedConfig.GetConfig. The config key LogConfigKey
+should contain a list of sink definitions. Each sink definition is an object
+with the following keys:
+
+scope      Scope of the sink (default is the root scope)
+level      Level of the sink e.g. Info (default is Info)
+formatter  One of console, simple, template or json (default is simple)
+template   Template string for the template formatter
+target     One of stdout, stderr, file or rollingfile (default is stdout)
+file       File name for the file and rollingfile targets
+maxsize    Size in bytes after which a rollingfile rolls over (default is 10MB)
+maxfiles   Number of old files which are kept by a rollingfile (default is 10)
+
+Sinks which were created by a previous call are removed and their files are
+closed. The previous sinks stay in place if the given config contains errors.
+*/
+func ApplyLogConfig(config map[string]interface{}) error {
+	var sinkConfs []logSinkConfig
+
+	confLock.Lock()
+	defer confLock.Unlock()
+
+	// Turn the generic config into sink definitions
+
+	data, err := json.Marshal(config[LogConfigKey])
+
+	if err == nil {
+		err = json.Unmarshal(data, &sinkConfs)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid log config: %v", err)
+	}
+
+	// Create all sinks before replacing the existing ones
+
+	sinks := make([]*configuredSink, 0, len(sinkConfs))
+
+	for _, sc := range sinkConfs {
+		var cs *configuredSink
+
+		if cs, err = sc.create(); err != nil {
+			closeConfiguredSinks(sinks)
+			return err
+		}
+
+		sinks = append(sinks, cs)
+	}
+
+	// Remove the previously configured sinks
+
+	for _, cs := range configuredSinks {
+		RemoveLogSink(cs.id)
+	}
+
+	closeConfiguredSinks(configuredSinks)
+
+	for _, cs := range sinks {
+		cs.id = addLogSink(cs.level, cs.scope, cs.formatter, cs.appender)
+	}
+
+	configuredSinks = sinks
+
+	return nil
+}
+
+/*
+configuredSinks are the sinks which were created by ApplyLogConfig.
+*/
+var configuredSinks []*configuredSink
+
+/*
+confLock protects configuredSinks.
+*/
+var confLock = &sync.Mutex{}
+
+/*
+logSinkConfig is the definition of a single log sink in a config.
+*/
+type logSinkConfig struct {
+	Scope     string `json:"scope"`
+	Level     string `json:"level"`
+	Formatter string `json:"formatter"`
+	Template  string `json:"template"`
+	Target    string `json:"target"`
+	File      string `json:"file"`
+	MaxSize   int64  `json:"maxsize"`
+	MaxFiles  int    `json:"maxfiles"`
+}
+
+/*
+configuredSink is a log sink which was created from a config.
+*/
+type configuredSink struct {
+	id        int       // Id of the sink once it was added
+	scope     string    // Scope of the sink
+	level     Level     // Level of the sink
+	formatter Formatter // Formatter of the sink
+	appender  io.Writer // Appender of the sink
+}
+
+/*
+create creates a log sink from its definition.
+*/
+func (sc logSinkConfig) create() (*configuredSink, error) {
+	var formatter Formatter
+	var appender io.Writer
+	var err error
+
+	level := Level(Info)
+
+	if sc.Level != "" {
+		if level, err = StringToLoglevel(sc.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	switch sc.Formatter {
+	case "", "simple":
+		formatter = SimpleFormatter()
+	case "console":
+		formatter = ConsoleFormatter()
+	case "json":
+		formatter = JSONFormatter()
+	case "template":
+		if sc.Template == "" {
+			return nil, fmt.Errorf("Template formatter requires a template")
+		}
+		formatter = TemplateFormatter(sc.Template)
+	default:
+		return nil, fmt.Errorf("Unknown log formatter: %v", sc.Formatter)
+	}
+
+	if (sc.Target == "file" || sc.Target == "rollingfile") && sc.File == "" {
+		return nil, fmt.Errorf("Log target %v requires a file", sc.Target)
+	}
+
+	switch sc.Target {
+	case "", "stdout":
+		appender = os.Stdout
+	case "stderr":
+		appender = os.Stderr
+	case "file":
+		appender, err = os.OpenFile(sc.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	case "rollingfile":
+		maxSize, maxFiles := sc.MaxSize, sc.MaxFiles
+
+		if maxSize <= 0 {
+			maxSize = 10 * 1024 * 1024
+		}
+
+		if maxFiles <= 0 {
+			maxFiles = 10
+		}
+
+		appender, err = fileutil.NewMultiFileBuffer(sc.File,
+			fileutil.ConsecutiveNumberIterator(maxFiles),
+			fileutil.SizeBasedRolloverCondition(maxSize))
+	default:
+		err = fmt.Errorf("Unknown log target: %v", sc.Target)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &configuredSink{0, sc.Scope, level, formatter, appender}, nil
+}
+
+/*
+closeConfiguredSinks closes all files of a given list of configured sinks.
+*/
+func closeConfiguredSinks(sinks []*configuredSink) {
+	for _, cs := range sinks {
+		if c, ok := cs.appender.(io.Closer); ok && cs.appender != os.Stdout && cs.appender != os.Stderr {
+			c.Close()
+		}
+	}
+}
+
+/*
+LogConfigWatcher applies the log config of a fileutil.WatchedConfig every
+time the config changes.
+*/
+type LogConfigWatcher struct {
+	wc       *fileutil.WatchedConfig // Watched config
+	interval time.Duration           // Interval with which the config is checked
+	last     interface{}             // Last applied log config
+	lastErr  error                   // Last error when applying the log config
+	errLock  *sync.Mutex             // Lock for lastErr
+	shutdown chan bool               // Signal channel for thread shutdown
+}
+
+/*
+NewLogConfigWatcher applies the log config of a given WatchedConfig and
+checks it for changes in a given interval. Every change is applied via
+ApplyLogConfig.
+*/
+func NewLogConfigWatcher(wc *fileutil.WatchedConfig, interval time.Duration) (*LogConfigWatcher, error) {
+	lw := &LogConfigWatcher{wc, interval, nil, nil, &sync.Mutex{}, make(chan bool)}
+
+	if err := lw.check(); err != nil {
+		return nil, err
+	}
+
+	go lw.watch()
+
+	return lw, nil
+}
+
+/*
+LastError returns the error of the last attempt to apply the log config.
+*/
+func (lw *LogConfigWatcher) LastError() error {
+	lw.errLock.Lock()
+	defer lw.errLock.Unlock()
+
+	return lw.lastErr
+}
+
+/*
+Close stops watching the config. The configured sinks stay in place.
+*/
+func (lw *LogConfigWatcher) Close() {
+	lw.shutdown <- true
+	<-lw.shutdown
+}
+
+/*
+watch is the internal watch goroutine function.
+*/
+func (lw *LogConfigWatcher) watch() {
+	for {
+		select {
+		case <-lw.shutdown:
+			close(lw.shutdown)
+			return
+		case <-time.After(lw.interval):
+		}
+
+		err := lw.check()
+
+		lw.errLock.Lock()
+		lw.lastErr = err
+		lw.errLock.Unlock()
+	}
+}
+
+/*
+check applies the log config if it has changed since the last check.
+*/
+func (lw *LogConfigWatcher) check() error {
+	config, err := lw.wc.GetConfig()
+
+	if err == nil && !reflect.DeepEqual(config[LogConfigKey], lw.last) {
+
+		if err = ApplyLogConfig(config); err == nil {
+			lw.last = config[LogConfigKey]
+		}
+	}
+
+	return err
+}
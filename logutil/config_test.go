@@ -0,0 +1,212 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhedin/Abe_common/fileutil"
+)
+
+func TestApplyLogConfig(t *testing.T) {
+	ClearLogSinks()
+
+	dir, err := ioutil.TempDir("", "logconfig")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "app.log")
+	rollFile := filepath.Join(dir, "roll.log")
+
+	var config map[string]interface{}
+
+	json.Unmarshal([]byte(`{
+  "LogSinks": [
+    {"scope": "foo", "level": "debug", "formatter": "template", "template": "[%l] %s %m", "target": "file", "file": "`+logFile+`"},
+    {"scope": "foo.bar", "level": "error", "formatter": "console", "target": "rollingfile", "file": "`+rollFile+`", "maxsize": 10, "maxfiles": 2},
+    {"scope": "bar", "target": "stderr"}
+  ]
+}`), &config)
+
+	if err := ApplyLogConfig(config); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 3 || res[0].Scope != "foo.bar" || res[0].Level != Error ||
+		res[1].Level != Debug || res[2].Level != Info || res[0].Appender != "*fileutil.MultiFileBuffer" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	GetLogger("foo").Debug("test1")
+	GetLogger("foo.bar").Error("test2")
+	GetLogger("foo.bar").Error("test3")
+
+	if res, _ := ioutil.ReadFile(logFile); string(res) != "[Debug] foo test1\n" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	if res, _ := ioutil.ReadFile(rollFile); string(res) != "Error: test3\n" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	if res, _ := ioutil.ReadFile(rollFile + ".1"); string(res) != "Error: test2\n" {
+		t.Error("Unexpected result:", string(res))
+		return
+	}
+
+	// Sinks which were added manually are kept when the config is applied again
+
+	GetLogger("manual").AddLogSink(Info, ConsoleFormatter(), os.Stdout)
+
+	json.Unmarshal([]byte(`{"LogSinks": [{"scope": "foo", "level": "warning", "target": "file", "file": "`+logFile+`"}]}`), &config)
+
+	if err := ApplyLogConfig(config); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 2 || res[0].Scope != "manual" || res[1].Level != Warning {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Test error cases - the previous config stays in place
+
+	for _, c := range []string{
+		`{"LogSinks": "foo"}`,
+		`{"LogSinks": [{"level": "foo"}]}`,
+		`{"LogSinks": [{"formatter": "foo"}]}`,
+		`{"LogSinks": [{"formatter": "template"}]}`,
+		`{"LogSinks": [{"target": "foo"}]}`,
+		`{"LogSinks": [{"target": "file"}]}`,
+		`{"LogSinks": [{"target": "stdout"}, {"target": "file", "file": "` + filepath.Join(dir, "x", "y") + `"}]}`,
+	} {
+		config = nil
+		json.Unmarshal([]byte(c), &config)
+
+		if err := ApplyLogConfig(config); err == nil {
+			t.Error("Unexpected result for:", c)
+			return
+		}
+	}
+
+	if res := LogSinks(); len(res) != 2 || res[1].Level != Warning {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// An empty config removes all configured sinks
+
+	if err := ApplyLogConfig(map[string]interface{}{}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 1 || res[0].Scope != "manual" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	ClearLogSinks()
+}
+
+func TestLogConfigWatcher(t *testing.T) {
+	ClearLogSinks()
+
+	dir, err := ioutil.TempDir("", "logconfig")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.json")
+
+	wc, err := fileutil.NewWatchedConfig(configFile, map[string]interface{}{
+		"LogSinks": []interface{}{map[string]interface{}{"scope": "foo", "level": "Info"}},
+	}, 10*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer wc.Close()
+
+	lw, err := NewLogConfigWatcher(wc, 10*time.Millisecond)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 1 || res[0].Level != Info {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// writeConfig replaces the config file atomically so the watcher never
+	// sees a partially written file
+
+	writeConfig := func(content string) {
+		tmpFile := configFile + ".tmp"
+		ioutil.WriteFile(tmpFile, []byte(content), 0644)
+		os.Rename(tmpFile, configFile)
+	}
+
+	writeConfig(`{"LogSinks": [{"scope": "foo", "level": "Debug"}]}`)
+
+	waitFor := func(check func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if check() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(func() bool {
+		res := LogSinks()
+		return len(res) == 1 && res[0].Level == Debug
+	}) {
+		t.Error("Unexpected result:", LogSinks())
+		return
+	}
+
+	writeConfig(`{"LogSinks": [{"scope": "foo", "level": "foo"}]}`)
+
+	if !waitFor(func() bool {
+		err := lw.LastError()
+		return err != nil && strings.Contains(err.Error(), "Unknown log level: foo")
+	}) {
+		t.Error("Unexpected result:", lw.LastError())
+		return
+	}
+
+	if res := LogSinks(); len(res) != 1 || res[0].Level != Debug {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	lw.Close()
+
+	ClearLogSinks()
+}
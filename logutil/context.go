@@ -0,0 +1,54 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import "context"
+
+/*
+contextKey is the type of the context key which holds log fields.
+*/
+type contextKey struct{}
+
+/*
+fieldsContextKey is the context key which holds log fields.
+*/
+var fieldsContextKey = contextKey{}
+
+/*
+ContextWithFields returns a copy of a given context which holds the given
+key/value pairs in addition to all fields which are already stored in the
+context. The fields are attached to all log messages of loggers which are
+retrieved via FromContext.
+*/
+func ContextWithFields(ctx context.Context, keysAndValues ...interface{}) context.Context {
+	l := &logger{"", FieldsFromContext(ctx)}
+	return context.WithValue(ctx, fieldsContextKey, l.withFields(keysAndValues))
+}
+
+/*
+FieldsFromContext returns all log fields which are stored in a given context.
+*/
+func FieldsFromContext(ctx context.Context) []Field {
+	if ctx == nil {
+		return nil
+	}
+
+	fields, _ := ctx.Value(fieldsContextKey).([]Field)
+
+	return fields
+}
+
+/*
+FromContext returns a logger of a certain scope which attaches all log fields
+stored in a given context to every log message.
+*/
+func FromContext(ctx context.Context, scope string) Logger {
+	return &logger{scope, FieldsFromContext(ctx)}
+}
@@ -0,0 +1,64 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+func TestContextLogging(t *testing.T) {
+	ClearLogSinks()
+
+	buf := &bytes.Buffer{}
+
+	GetLogger("").AddLogSink(Debug, ConsoleFormatter(), buf)
+
+	ctx := ContextWithFields(context.Background(), "requestid", "r1")
+	ctx2 := ContextWithFields(ctx, "user", "foo", "session", "s1")
+
+	if res := fmt.Sprint(FieldsFromContext(ctx2)); res != "[{requestid r1} {user foo} {session s1}]" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if res := FieldsFromContext(nil); res != nil {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	FromContext(context.Background(), "foo").Info("test1")
+	FromContext(ctx, "foo").Info("test2")
+	FromContext(ctx2, "foo").With("a", 1).Infow("test3", "b", 2)
+
+	// The parent context is not modified
+
+	FromContext(ctx, "foo").Info("test4")
+
+	// Fields of the context are also used by slog
+
+	slog.New(NewSlogHandler("foo")).InfoContext(ctx2, "test5", "c", 3)
+
+	if buf.String() != `
+Info: test1
+Info: test2 requestid=r1
+Info: test3 requestid=r1 user=foo session=s1 a=1 b=2
+Info: test4 requestid=r1
+Info: test5 requestid=r1 user=foo session=s1 c=3
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	ClearLogSinks()
+}
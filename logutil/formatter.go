@@ -2,6 +2,8 @@ package logutil
 
 import (
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/rhedin/Abe_common/testutil"
@@ -19,6 +21,19 @@ type Formatter interface {
 	Format(level Level, scope string, msg ...interface{}) string
 }
 
+/*
+StructuredFormatter is a formatter which can render structured key/value
+fields of a log message.
+*/
+type StructuredFormatter interface {
+	Formatter
+
+	/*
+	   FormatFields formats a given log message with its key/value fields into a string.
+	*/
+	FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string
+}
+
 /*
 ConsoleFormatter returns a simple formatter which does a simple fmt.Sprintln
 on all log messages. It only adds the log level.
@@ -37,7 +52,18 @@ type consoleFormatter struct {
 Format formats a given log message into a string.
 */
 func (sf *consoleFormatter) Format(level Level, scope string, msg ...interface{}) string {
-	return fmt.Sprintln(fmt.Sprintf("%v:", level), fmt.Sprint(msg...))
+	return sf.FormatFields(level, scope, nil, msg...)
+}
+
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+*/
+func (sf *consoleFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	if len(fields) == 0 {
+		return fmt.Sprintln(fmt.Sprintf("%v:", level), fmt.Sprint(msg...))
+	}
+
+	return fmt.Sprintln(fmt.Sprintf("%v:", level), fmt.Sprint(msg...), fieldsToString(fields))
 }
 
 /*
@@ -60,11 +86,26 @@ type simpleFormatter struct {
 Format formats a given log message into a string.
 */
 func (sf *simpleFormatter) Format(level Level, scope string, msg ...interface{}) string {
-	if scope == "" {
-		return fmt.Sprintln(sf.tsFunc(), level, fmt.Sprint(msg...))
+	return sf.FormatFields(level, scope, nil, msg...)
+}
+
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+*/
+func (sf *simpleFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	out := []interface{}{sf.tsFunc(), level}
+
+	if scope != "" {
+		out = append(out, scope)
+	}
+
+	out = append(out, fmt.Sprint(msg...))
+
+	if len(fields) > 0 {
+		out = append(out, fieldsToString(fields))
 	}
 
-	return fmt.Sprintln(sf.tsFunc(), level, scope, fmt.Sprint(msg...))
+	return fmt.Sprintln(out...)
 }
 
 /*
@@ -78,6 +119,10 @@ following directives:
 %f         Function in which the log message was issued e.g. foo.bar.MyFunc()
 %c         Code location of the log statement which issuing the log message e.g. package/somefile.go:12
 %m         The log message and its arguments formatted with fmt.Sprintf()
+%k         The key/value fields of the log message e.g. requestid=123 user=foo
+
+Key/value fields are appended to the output if the template does not contain
+the %k directive.
 */
 func TemplateFormatter(template string) Formatter {
 	return &templateFormatter{template, timeutil.MakeTimestamp}
@@ -95,8 +140,22 @@ type templateFormatter struct {
 Format formats a given log message into a string.
 */
 func (sf *templateFormatter) Format(level Level, scope string, msg ...interface{}) string {
+	return sf.format(level, scope, nil, msg...)
+}
 
-	name, loc := testutil.GetCaller(2)
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+*/
+func (sf *templateFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	return sf.format(level, scope, fields, msg...)
+}
+
+/*
+format produces the actual log message from the template.
+*/
+func (sf *templateFormatter) format(level Level, scope string, fields []Field, msg ...interface{}) string {
+
+	name, loc := getCaller()
 
 	out := sf.template
 
@@ -107,5 +166,62 @@ func (sf *templateFormatter) Format(level Level, scope string, msg ...interface{
 	out = strings.Replace(out, "%c", loc, -1)
 	out = strings.Replace(out, "%m", fmt.Sprint(msg...), -1)
 
+	if strings.Contains(sf.template, "%k") {
+		out = strings.Replace(out, "%k", fieldsToString(fields), -1)
+	} else if len(fields) > 0 {
+		out = fmt.Sprint(out, " ", fieldsToString(fields))
+	}
+
 	return fmt.Sprintln(out)
 }
+
+/*
+fieldsToString renders a list of key/value fields as a string of the form
+key1=value1 key2=value2. Values which contain spaces, quotes or equal signs
+are quoted.
+*/
+func fieldsToString(fields []Field) string {
+	var buf strings.Builder
+
+	for i, f := range fields {
+
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+
+		val := fmt.Sprint(f.Value)
+
+		if val == "" || strings.ContainsAny(val, " \t\n\"=") {
+			val = strconv.Quote(val)
+		}
+
+		buf.WriteString(f.Key)
+		buf.WriteString("=")
+		buf.WriteString(val)
+	}
+
+	return buf.String()
+}
+
+/*
+packagePrefix is the prefix of all function names of this package.
+*/
+var packagePrefix = reflect.TypeOf(logger{}).PkgPath() + "."
+
+/*
+getCaller returns the function and code location which issued the current
+log message. All frames of this package (except tests) and of log/slog are
+skipped so the result does not depend on how many formatters are wrapped into
+each other or if the message was issued through slog.
+*/
+func getCaller() (string, string) {
+	for level := 1; ; level++ {
+		name, loc := testutil.GetCaller(level)
+
+		internal := strings.HasPrefix(name, packagePrefix) || strings.HasPrefix(name, "log/slog.")
+
+		if name == "n/a" || !internal || strings.Contains(loc, "_test.go:") {
+			return name, loc
+		}
+	}
+}
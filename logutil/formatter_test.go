@@ -70,3 +70,51 @@ Warning: bar
 		return
 	}
 }
+
+func TestFormattingFields(t *testing.T) {
+	ClearLogSinks()
+
+	sf := TemplateFormatter("[%l] %m {%k}")
+
+	rootBuf := &bytes.Buffer{}
+	logger := GetLogger("").With("id", 1)
+
+	logger.AddLogSink(Debug, sf, rootBuf)
+
+	logger.Infow("foo", "user", "bar")
+	logger.Warning("bar")
+
+	if rootBuf.String() != `
+[Info] foo {id=1 user=bar}
+[Warning] bar {id=1}
+`[1:] {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+
+	ClearLogSinks()
+
+	rootBuf.Reset()
+
+	logger.AddLogSink(Debug, TemplateFormatter("%c - %m"), rootBuf)
+
+	logger.Infow("foo", "user", "bar")
+
+	if !strings.Contains(rootBuf.String(), "formatter_test.go:101 - foo id=1 user=bar") {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+
+	ClearLogSinks()
+
+	rootBuf.Reset()
+
+	logger.AddLogSink(Debug, ConsoleFormatter(), rootBuf)
+
+	logger.Infow("foo", "user", "bar")
+
+	if rootBuf.String() != "Info: foo id=1 user=bar\n" {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+}
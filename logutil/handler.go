@@ -0,0 +1,103 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+LogSinksHandler returns a HTTP handler which exposes the configured log sinks
+as JSON. The following requests are supported:
+
+GET     Returns a list of all configured log sinks.
+PUT     Changes the level of a log sink (body: {"id": 1, "level": "Debug", "duration": "10m"}).
+DELETE  Removes a log sink (body: {"id": 1}).
+
+The duration of a level change is optional - if it is given the previous level
+is restored once the duration has passed.
+
+All successful requests return the list of configured log sinks.
+*/
+func LogSinksHandler() http.Handler {
+	return &logSinksHandler{}
+}
+
+/*
+logSinksHandler is the log sinks handler implementation.
+*/
+type logSinksHandler struct {
+}
+
+/*
+logSinksRequest models the request body of a PUT or DELETE request.
+*/
+type logSinksRequest struct {
+	ID       int    `json:"id"`
+	Level    string `json:"level"`
+	Duration string `json:"duration"`
+}
+
+/*
+ServeHTTP serves HTTP requests.
+*/
+func (lh *logSinksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.Method {
+
+	case http.MethodGet:
+
+	case http.MethodPut, http.MethodDelete:
+		var req logSinksRequest
+
+		if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+			if r.Method == http.MethodPut {
+				err = lh.setLevel(req)
+			} else {
+				err = RemoveLogSink(req.ID)
+			}
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(LogSinks())
+}
+
+/*
+setLevel changes the level of a log sink according to a given request.
+*/
+func (lh *logSinksHandler) setLevel(req logSinksRequest) error {
+	var d time.Duration
+
+	level, err := StringToLoglevel(req.Level)
+
+	if err == nil && req.Duration != "" {
+		d, err = time.ParseDuration(req.Duration)
+	}
+
+	if err == nil {
+		err = SetLogSinkLevelFor(req.ID, level, d)
+	}
+
+	return err
+}
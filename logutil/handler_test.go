@@ -0,0 +1,87 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogSinksHandler(t *testing.T) {
+	ClearLogSinks()
+
+	GetLogger("foo").AddLogSink(Info, ConsoleFormatter(), &bytes.Buffer{})
+	GetLogger("foo").AddLogSink(Error, ConsoleFormatter(), &bytes.Buffer{})
+
+	id := LogSinks()[0].ID
+
+	handler := LogSinksHandler()
+
+	send := func(method string, body string) (int, string) {
+		req := httptest.NewRequest(method, "/logsinks", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, res := send("GET", ""); code != http.StatusOK || res != fmt.Sprintf(`[{"id":%v,"scope":"foo","level":"Info","formatter":"*logutil.consoleFormatter","appender":"*bytes.Buffer"},`+
+		`{"id":%v,"scope":"foo","level":"Error","formatter":"*logutil.consoleFormatter","appender":"*bytes.Buffer"}]`+"\n", id, id+1) {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	if code, res := send("PUT", fmt.Sprintf(`{"id":%v,"level":"debug","duration":"10m"}`, id)); code != http.StatusOK ||
+		!strings.Contains(res, `"level":"Debug"`) {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	if code, res := send("DELETE", fmt.Sprintf(`{"id":%v}`, id)); code != http.StatusOK ||
+		strings.Contains(res, `"level":"Debug"`) || !strings.Contains(res, `"level":"Error"`) {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	// Test error cases
+
+	if code, res := send("PUT", fmt.Sprintf(`{"id":%v,"level":"foo"}`, id+1)); code != http.StatusBadRequest ||
+		res != "Unknown log level: foo\n" {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	if code, res := send("PUT", fmt.Sprintf(`{"id":%v,"level":"info","duration":"x"}`, id+1)); code != http.StatusBadRequest ||
+		!strings.Contains(res, "invalid duration") {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	if code, res := send("DELETE", fmt.Sprintf(`{"id":%v}`, id)); code != http.StatusBadRequest ||
+		res != fmt.Sprintf("Unknown log sink: %v\n", id) {
+		t.Error("Unexpected result:", code, res)
+		return
+	}
+
+	if code, _ := send("PUT", "{"); code != http.StatusBadRequest {
+		t.Error("Unexpected result:", code)
+		return
+	}
+
+	if code, _ := send("POST", ""); code != http.StatusMethodNotAllowed {
+		t.Error("Unexpected result:", code)
+		return
+	}
+
+	ClearLogSinks()
+}
@@ -0,0 +1,106 @@
+package logutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rhedin/Abe_common/timeutil"
+)
+
+/*
+JSONFormatter returns a formatter which produces one JSON object per log
+message. Each object is terminated by a newline and contains the following
+keys:
+
+timestamp  Current timestamp (milliseconds elapsed since January 1, 1970 UTC)
+level      The level of the log message
+scope      The scope of the log message
+message    The log message and its arguments formatted with fmt.Sprint()
+function   Function in which the log message was issued e.g. foo.bar.MyFunc()
+caller     Code location of the log statement e.g. package/somefile.go:12
+fields     Object containing the key/value fields of the log message (only if there are any)
+*/
+func JSONFormatter() Formatter {
+	return &jsonFormatter{timeutil.MakeTimestamp}
+}
+
+/*
+jsonFormatter is the JSON formatter implementation.
+*/
+type jsonFormatter struct {
+	tsFunc func() string // Timestamp function
+}
+
+/*
+Format formats a given log message into a string.
+*/
+func (jf *jsonFormatter) Format(level Level, scope string, msg ...interface{}) string {
+	return jf.format(level, scope, nil, msg...)
+}
+
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+*/
+func (jf *jsonFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	return jf.format(level, scope, fields, msg...)
+}
+
+/*
+format produces the actual JSON object.
+*/
+func (jf *jsonFormatter) format(level Level, scope string, fields []Field, msg ...interface{}) string {
+	var buf strings.Builder
+
+	name, loc := getCaller()
+
+	writeJSONPair(&buf, "timestamp", jf.tsFunc(), true)
+	writeJSONPair(&buf, "level", fmt.Sprint(level), false)
+	writeJSONPair(&buf, "scope", scope, false)
+	writeJSONPair(&buf, "message", fmt.Sprint(msg...), false)
+	writeJSONPair(&buf, "function", name, false)
+	writeJSONPair(&buf, "caller", loc, false)
+
+	if len(fields) > 0 {
+		buf.WriteString(`,"fields":`)
+
+		for i, f := range fields {
+			writeJSONPair(&buf, f.Key, f.Value, i == 0)
+		}
+
+		buf.WriteString("}")
+	}
+
+	buf.WriteString("}\n")
+
+	return buf.String()
+}
+
+/*
+writeJSONPair writes a single key/value pair of a JSON object. The pair opens
+a new object if first is set. Values which cannot be marshalled are written as
+strings.
+*/
+func writeJSONPair(buf *strings.Builder, key string, value interface{}, first bool) {
+
+	if first {
+		buf.WriteString("{")
+	} else {
+		buf.WriteString(",")
+	}
+
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
@@ -0,0 +1,66 @@
+package logutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONFormatting(t *testing.T) {
+	ClearLogSinks()
+
+	jf := JSONFormatter()
+
+	jf.(*jsonFormatter).tsFunc = func() string {
+		return "0000000000000" // Timestamp for testing is always 0
+	}
+
+	rootBuf := &bytes.Buffer{}
+	logger := GetLogger("foo")
+
+	logger.AddLogSink(Debug, jf, rootBuf)
+
+	logger.Info("say \"hello\"\n\tworld <&>")
+	logger.With("id", 1).Errorw("failed", "err", fmt.Errorf("test\"error"),
+		"data", map[string]int{"a": 1}, "ch", make(chan int))
+
+	lines := strings.Split(strings.TrimSpace(rootBuf.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+
+	var res map[string]interface{}
+
+	if err := json.Unmarshal([]byte(lines[0]), &res); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res["timestamp"] != "0000000000000" || res["level"] != "Info" ||
+		res["scope"] != "foo" || res["message"] != "say \"hello\"\n\tworld <&>" ||
+		!strings.HasSuffix(fmt.Sprint(res["function"]), "TestJSONFormatting") ||
+		!strings.Contains(fmt.Sprint(res["caller"]), "formatter_test.go:") {
+		t.Error("Unexpected output:", lines[0])
+		return
+	}
+
+	if _, ok := res["fields"]; ok {
+		t.Error("Unexpected output:", lines[0])
+		return
+	}
+
+	if !strings.HasPrefix(lines[1], `{"timestamp":"0000000000000","level":"Error","scope":"foo","message":"failed",`) ||
+		!strings.Contains(lines[1], `"fields":{"id":1,"err":"test\"error","data":{"a":1},"ch":"0x`) {
+		t.Error("Unexpected output:", lines[1])
+		return
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &res); err != nil {
+		t.Error(err)
+		return
+	}
+}
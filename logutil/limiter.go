@@ -0,0 +1,488 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+holdingFormatter is implemented by formatters which hold back output, e.g.
+the summaries of suppressed log messages. The held back output is written
+to the log sink of the formatter once it is due and when the sink is removed.
+*/
+type holdingFormatter interface {
+	Formatter
+
+	/*
+		attach returns the formatter instance for a log sink and sets the
+		function which is called once held back output is due. The function
+		writes the output which is returned by a given function. A formatter
+		which is already attached to another sink returns a new instance with
+		the same settings so each sink keeps its own state.
+	*/
+	attach(output func(due func() string)) holdingFormatter
+
+	/*
+		flush returns all held back output and stops calling the output function.
+	*/
+	flush() string
+}
+
+/*
+DedupFormatter returns a formatter which collapses identical log messages.
+Log messages which have the same level, scope and message as a previous log
+message within a given time window are suppressed. Once the window has passed
+a single line with a "repeated N times" suffix is produced - in front of the
+next log message which is handled by the formatter or on its own if no other
+log message arrives. Pending lines are written when the log sink is removed.
+The actual formatting is done by a given formatter.
+*/
+func DedupFormatter(formatter Formatter, window time.Duration) Formatter {
+	return &dedupFormatter{formatter, window, make(map[dedupKey]*dedupEntry),
+		0, &sync.Mutex{}, time.Now, nil, nil}
+}
+
+/*
+dedupKey identifies identical log messages.
+*/
+type dedupKey struct {
+	level Level
+	scope string
+	msg   string
+}
+
+/*
+dedupEntry records the repetitions of a log message.
+*/
+type dedupEntry struct {
+	start time.Time // Start of the time window
+	seq   uint64    // Sequence number of the first occurrence
+	count int       // Number of suppressed repetitions
+}
+
+/*
+dedupFormatter is the deduplicating formatter implementation.
+*/
+type dedupFormatter struct {
+	formatter Formatter                // Formatter which does the actual formatting
+	window    time.Duration            // Time window for identical log messages
+	seen      map[dedupKey]*dedupEntry // Log messages seen within their time window
+	seq       uint64                   // Sequence counter for first occurrences
+	lock      *sync.Mutex              // Lock for seen map
+	now       func() time.Time         // Function returning the current time
+	output    func(func() string)      // Function which writes due output to the log sink
+	timer     *time.Timer              // Timer for the next window with suppressed messages
+}
+
+/*
+Format formats a given log message into a string.
+*/
+func (df *dedupFormatter) Format(level Level, scope string, msg ...interface{}) string {
+	return df.FormatFields(level, scope, nil, msg...)
+}
+
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+Returns an empty string if the log message is suppressed.
+*/
+func (df *dedupFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	now := df.now()
+	key := dedupKey{level, scope, fmt.Sprint(msg...)}
+
+	// Report all messages whose time window has passed
+
+	out := df.expire(now)
+
+	if e, ok := df.seen[key]; ok {
+		e.count++
+		df.schedule(now)
+		return out
+	}
+
+	df.seq++
+	df.seen[key] = &dedupEntry{now, df.seq, 0}
+
+	return out + formatLog(df.formatter, level, scope, fields, msg...)
+}
+
+/*
+attach returns the formatter instance for a log sink and sets the function
+which is called once held back output is due.
+*/
+func (df *dedupFormatter) attach(output func(due func() string)) holdingFormatter {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	if df.output != nil {
+		nf := DedupFormatter(df.formatter, df.window).(*dedupFormatter)
+		nf.now = df.now
+		nf.output = output
+		return nf
+	}
+
+	df.output = output
+
+	return df
+}
+
+/*
+flush returns the "repeated N times" lines of all entries and stops calling
+the output function.
+*/
+func (df *dedupFormatter) flush() string {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	if df.timer != nil {
+		df.timer.Stop()
+		df.timer = nil
+	}
+
+	df.output = nil
+
+	return df.expire(time.Time{})
+}
+
+/*
+schedule starts the timer for the next time window which has passed while
+it has suppressed messages. The caller must hold the lock.
+*/
+func (df *dedupFormatter) schedule(now time.Time) {
+	if df.output == nil || df.timer != nil {
+		return
+	}
+
+	var next *dedupEntry
+
+	for _, e := range df.seen {
+		if e.count > 0 && (next == nil || e.start.Before(next.start)) {
+			next = e
+		}
+	}
+
+	if next != nil {
+		output := df.output
+
+		df.timer = time.AfterFunc(next.start.Add(df.window).Sub(now), func() {
+			output(df.due)
+		})
+	}
+}
+
+/*
+due returns the "repeated N times" lines of all time windows which have
+passed.
+*/
+func (df *dedupFormatter) due() string {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	if df.timer == nil {
+
+		// The output was flushed in the meantime
+
+		return ""
+	}
+
+	now := df.now()
+
+	df.timer = nil
+	out := df.expire(now)
+	df.schedule(now)
+
+	return out
+}
+
+/*
+expire removes all entries whose time window has passed (all entries for a
+zero time) and returns the "repeated N times" lines for them.
+*/
+func (df *dedupFormatter) expire(now time.Time) string {
+	var expired []dedupKey
+
+	for k, e := range df.seen {
+		if now.IsZero() || now.Sub(e.start) >= df.window {
+			expired = append(expired, k)
+		}
+	}
+
+	// Produce the lines in the order in which the messages first occurred
+
+	sort.Slice(expired, func(i, j int) bool {
+		return df.seen[expired[i]].seq < df.seen[expired[j]].seq
+	})
+
+	out := ""
+
+	for _, k := range expired {
+
+		if count := df.seen[k].count; count > 0 {
+			out += formatLog(df.formatter, k.level, k.scope, nil,
+				fmt.Sprintf("%v (repeated %v times)", k.msg, count))
+		}
+
+		delete(df.seen, k)
+	}
+
+	return out
+}
+
+/*
+RateLimitFormatter returns a formatter which limits the number of log
+messages per scope using a token bucket. Each scope may produce up to burst
+log messages at once and rate log messages per second on average. Suppressed
+log messages are reported in a single line once the scope has a token again -
+in front of the next log message of the scope which is handled by the
+formatter or on its own if no other log message arrives. Pending lines are
+written when the log sink is removed. The actual formatting is done by a
+given formatter.
+*/
+func RateLimitFormatter(formatter Formatter, rate float64, burst int) Formatter {
+	return &rateLimitFormatter{formatter, rate, float64(burst),
+		make(map[string]*tokenBucket), &sync.Mutex{}, time.Now, nil, nil, time.Time{}}
+}
+
+/*
+tokenBucket is the token bucket of a single scope.
+*/
+type tokenBucket struct {
+	tokens     float64   // Available tokens
+	last       time.Time // Last time the tokens were updated
+	suppressed int       // Number of suppressed log messages
+}
+
+/*
+rateLimitFormatter is the rate limiting formatter implementation.
+*/
+type rateLimitFormatter struct {
+	formatter Formatter               // Formatter which does the actual formatting
+	rate      float64                 // Tokens which are added per second
+	burst     float64                 // Maximum number of tokens
+	buckets   map[string]*tokenBucket // Token buckets for each scope
+	lock      *sync.Mutex             // Lock for buckets map
+	now       func() time.Time        // Function returning the current time
+	output    func(func() string)     // Function which writes due output to the log sink
+	timer     *time.Timer             // Timer for the next scope with suppressed messages
+	pruned    time.Time               // Last time full buckets were removed
+}
+
+/*
+Format formats a given log message into a string.
+*/
+func (rf *rateLimitFormatter) Format(level Level, scope string, msg ...interface{}) string {
+	return rf.FormatFields(level, scope, nil, msg...)
+}
+
+/*
+FormatFields formats a given log message with its key/value fields into a string.
+Returns an empty string if the log message is suppressed.
+*/
+func (rf *rateLimitFormatter) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	now := rf.now()
+
+	rf.prune(now)
+
+	b, ok := rf.buckets[scope]
+
+	if !ok {
+		b = &tokenBucket{rf.burst, now, 0}
+		rf.buckets[scope] = b
+	}
+
+	rf.refill(b, now)
+
+	if b.tokens < 1 {
+		b.suppressed++
+		rf.schedule(now)
+		return ""
+	}
+
+	b.tokens--
+
+	return rf.report(scope, b) + formatLog(rf.formatter, level, scope, fields, msg...)
+}
+
+/*
+attach returns the formatter instance for a log sink and sets the function
+which is called once held back output is due.
+*/
+func (rf *rateLimitFormatter) attach(output func(due func() string)) holdingFormatter {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.output != nil {
+		nf := RateLimitFormatter(rf.formatter, rf.rate, int(rf.burst)).(*rateLimitFormatter)
+		nf.now = rf.now
+		nf.output = output
+		return nf
+	}
+
+	rf.output = output
+
+	return rf
+}
+
+/*
+flush returns the suppressed message lines of all scopes and stops calling
+the output function.
+*/
+func (rf *rateLimitFormatter) flush() string {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.timer != nil {
+		rf.timer.Stop()
+		rf.timer = nil
+	}
+
+	rf.output = nil
+
+	return rf.expire(time.Time{})
+}
+
+/*
+schedule starts the timer for the next scope with suppressed messages which
+gets a token again. The caller must hold the lock.
+*/
+func (rf *rateLimitFormatter) schedule(now time.Time) {
+	if rf.output == nil || rf.timer != nil || rf.rate <= 0 {
+		return
+	}
+
+	var wait float64 = -1
+
+	for _, b := range rf.buckets {
+		if b.suppressed > 0 {
+			if w := (1 - b.tokens) / rf.rate; wait < 0 || w < wait {
+				wait = w
+			}
+		}
+	}
+
+	if wait >= 0 {
+		output := rf.output
+
+		rf.timer = time.AfterFunc(time.Duration(wait*float64(time.Second)), func() {
+			output(rf.due)
+		})
+	}
+}
+
+/*
+due returns the suppressed message lines of all scopes which have a token
+again.
+*/
+func (rf *rateLimitFormatter) due() string {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.timer == nil {
+
+		// The output was flushed in the meantime
+
+		return ""
+	}
+
+	now := rf.now()
+
+	rf.timer = nil
+	out := rf.expire(now)
+	rf.schedule(now)
+
+	return out
+}
+
+/*
+expire returns the suppressed message lines of all scopes which have a token
+again (all scopes for a zero time).
+*/
+func (rf *rateLimitFormatter) expire(now time.Time) string {
+	var scopes []string
+
+	for scope, b := range rf.buckets {
+		if b.suppressed > 0 {
+			if !now.IsZero() {
+				rf.refill(b, now)
+			}
+
+			if now.IsZero() || b.tokens >= 1 {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	sort.Strings(scopes)
+
+	out := ""
+
+	for _, scope := range scopes {
+		out += rf.report(scope, rf.buckets[scope])
+	}
+
+	return out
+}
+
+/*
+prune removes all buckets which are full and have no suppressed messages.
+Such buckets are in the same state as new buckets. Buckets are only checked
+once per time it takes to fill an empty bucket. The caller must hold the lock.
+*/
+func (rf *rateLimitFormatter) prune(now time.Time) {
+	if rf.rate <= 0 || now.Sub(rf.pruned).Seconds() < rf.burst/rf.rate {
+		return
+	}
+
+	rf.pruned = now
+
+	for scope, b := range rf.buckets {
+		if rf.refill(b, now); b.suppressed == 0 && b.tokens >= rf.burst {
+			delete(rf.buckets, scope)
+		}
+	}
+}
+
+/*
+refill adds the tokens for the time which has passed since the last update
+of a given bucket.
+*/
+func (rf *rateLimitFormatter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rf.rate
+	b.last = now
+
+	if b.tokens > rf.burst {
+		b.tokens = rf.burst
+	}
+}
+
+/*
+report returns the suppressed message line of a given bucket and resets its
+count.
+*/
+func (rf *rateLimitFormatter) report(scope string, b *tokenBucket) string {
+	out := ""
+
+	if b.suppressed > 0 {
+		out = formatLog(rf.formatter, Warning, scope, nil,
+			fmt.Sprintf("%v log messages were suppressed by rate limit", b.suppressed))
+		b.suppressed = 0
+	}
+
+	return out
+}
@@ -0,0 +1,303 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupFormatter(t *testing.T) {
+	ClearLogSinks()
+
+	now := time.Unix(0, 0)
+
+	df := DedupFormatter(ConsoleFormatter(), time.Second)
+	df.(*dedupFormatter).now = func() time.Time {
+		return now
+	}
+
+	buf := &bytes.Buffer{}
+	logger := GetLogger("foo")
+
+	logger.AddLogSink(Debug, df, buf)
+
+	logger.Error("test1")
+	logger.Error("test1")
+	logger.Error("test1")
+	logger.Warning("test1")
+	logger.Errorw("test2", "a", 1)
+	logger.Errorw("test2", "a", 2)
+
+	now = now.Add(500 * time.Millisecond)
+
+	logger.Error("test1")
+
+	if buf.String() != `
+Error: test1
+Warning: test1
+Error: test2 a=1
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	now = now.Add(600 * time.Millisecond)
+
+	logger.Info("test3")
+
+	if buf.String() != `
+Error: test1
+Warning: test1
+Error: test2 a=1
+Error: test1 (repeated 3 times)
+Error: test2 (repeated 1 times)
+Info: test3
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// A new window starts after the old one has passed
+
+	buf.Reset()
+
+	logger.Error("test1")
+	logger.Error("test1")
+
+	if buf.String() != "Error: test1\n" {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Wrapped formatters still see the original caller
+
+	ClearLogSinks()
+
+	buf.Reset()
+
+	logger.AddLogSink(Debug, DedupFormatter(TemplateFormatter("%c %m"), time.Second), buf)
+
+	logger.Info("test4")
+
+	if !strings.Contains(buf.String(), "limiter_test.go:") {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	ClearLogSinks()
+
+	// Repetitions are reported even if no further message arrives
+
+	buf.Reset()
+
+	logger.AddLogSink(Debug, DedupFormatter(ConsoleFormatter(), 20*time.Millisecond), buf)
+
+	logger.Error("test5")
+	logger.Error("test5")
+	logger.Error("test5")
+
+	time.Sleep(100 * time.Millisecond)
+
+	ClearLogSinks()
+
+	if buf.String() != `
+Error: test5
+Error: test5 (repeated 2 times)
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Pending repetitions are reported when the sink is removed
+
+	buf.Reset()
+
+	logger.AddLogSink(Debug, DedupFormatter(ConsoleFormatter(), time.Hour), buf)
+
+	logger.Error("test6")
+	logger.Error("test6")
+	logger.Info("test7")
+
+	RemoveLogSink(LogSinks()[0].ID)
+
+	if buf.String() != `
+Error: test6
+Info: test7
+Error: test6 (repeated 1 times)
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+}
+
+func TestRateLimitFormatter(t *testing.T) {
+	ClearLogSinks()
+
+	now := time.Unix(0, 0)
+
+	rf := RateLimitFormatter(ConsoleFormatter(), 2, 3)
+	rf.(*rateLimitFormatter).now = func() time.Time {
+		return now
+	}
+
+	buf := &bytes.Buffer{}
+
+	GetLogger("").AddLogSink(Debug, rf, buf)
+
+	foo := GetLogger("foo")
+	bar := GetLogger("bar")
+
+	for i := 0; i < 5; i++ {
+		foo.Info("foo", i)
+	}
+
+	bar.Info("bar")
+
+	if buf.String() != `
+Info: foo0
+Info: foo1
+Info: foo2
+Info: bar
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Half a second gives one new token
+
+	now = now.Add(500 * time.Millisecond)
+
+	foo.Info("foo", 5)
+	foo.Info("foo", 6)
+
+	if buf.String() != `
+Info: foo0
+Info: foo1
+Info: foo2
+Info: bar
+Warning: 2 log messages were suppressed by rate limit
+Info: foo5
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// The bucket does not grow beyond the burst size
+
+	now = now.Add(time.Hour)
+
+	buf.Reset()
+
+	for i := 0; i < 5; i++ {
+		foo.Info("foo", i)
+	}
+
+	if buf.String() != `
+Warning: 1 log messages were suppressed by rate limit
+Info: foo0
+Info: foo1
+Info: foo2
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Buckets which are full again are removed
+
+	now = now.Add(time.Hour)
+
+	foo.Info("foo")
+
+	now = now.Add(time.Hour)
+
+	bar.Info("bar")
+
+	if _, ok := rf.(*rateLimitFormatter).buckets["foo"]; ok || len(rf.(*rateLimitFormatter).buckets) != 1 {
+		t.Error("Unexpected buckets:", rf.(*rateLimitFormatter).buckets)
+		return
+	}
+
+	ClearLogSinks()
+
+	// Suppressed messages are reported even if no further message arrives
+
+	buf.Reset()
+
+	GetLogger("").AddLogSink(Debug, RateLimitFormatter(ConsoleFormatter(), 50, 1), buf)
+
+	foo.Info("foo1")
+	foo.Info("foo2")
+	foo.Info("foo3")
+
+	time.Sleep(100 * time.Millisecond)
+
+	ClearLogSinks()
+
+	if buf.String() != `
+Info: foo1
+Warning: 2 log messages were suppressed by rate limit
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Suppressed messages are reported when the sink is removed
+
+	buf.Reset()
+
+	GetLogger("").AddLogSink(Debug, RateLimitFormatter(ConsoleFormatter(), 0.001, 1), buf)
+
+	foo.Info("foo1")
+	foo.Info("foo2")
+
+	RemoveLogSink(LogSinks()[0].ID)
+
+	if buf.String() != `
+Info: foo1
+Warning: 1 log messages were suppressed by rate limit
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+}
+
+func TestSharedHoldingFormatter(t *testing.T) {
+	ClearLogSinks()
+
+	// Each sink of a shared formatter keeps its own state
+
+	df := DedupFormatter(ConsoleFormatter(), time.Hour)
+
+	buf1 := &bytes.Buffer{}
+	buf2 := &bytes.Buffer{}
+
+	logger := GetLogger("foo")
+
+	logger.AddLogSink(Debug, df, buf1)
+	logger.AddLogSink(Debug, df, buf2)
+
+	logger.Error("test1")
+	logger.Error("test1")
+
+	ClearLogSinks()
+
+	expected := `
+Error: test1
+Error: test1 (repeated 1 times)
+`[1:]
+
+	if buf1.String() != expected || buf2.String() != expected {
+		t.Error("Unexpected output:", buf1.String(), buf2.String())
+		return
+	}
+}
@@ -27,6 +27,16 @@ Example:
 	logger.AddLogSink(Info, SimpleFormatter(), myLogFile)
 
 	logger.Info("A log message")
+
+Structured key/value fields can be attached to a child logger via With or
+given directly to the log methods ending in w (e.g. Infow). Fields are passed
+on to the formatter as separate key/value pairs.
+
+Example:
+
+	logger = GetLogger("foo.bar").With("requestid", 123)
+
+	logger.Infow("Request served", "duration", d)
 */
 package logutil
 
@@ -38,6 +48,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 /*
@@ -54,38 +65,105 @@ type Level string
 Log levels
 */
 const (
+	Trace   Level = "Trace"
 	Debug   Level = "Debug"
 	Info          = "Info"
 	Warning       = "Warning"
 	Error         = "Error"
+	Fatal         = "Fatal"
 )
 
 /*
 LogLevelPriority is a map assigning priorities to log level (lower number means a higher priority)
 */
 var logLevelPriority = map[Level]int{
-	Debug:   1,
-	Info:    2,
-	Warning: 3,
-	Error:   4,
+	Trace:   10,
+	Debug:   20,
+	Info:    30,
+	Warning: 40,
+	Error:   50,
+	Fatal:   60,
 }
 
 /*
 stringToLoglevel is a map assigning log levels to strings.
 */
 var stringToLoglevel = map[string]Level{
+	strings.ToLower(fmt.Sprint(Trace)):   Trace,
 	strings.ToLower(fmt.Sprint(Debug)):   Debug,
 	strings.ToLower(fmt.Sprint(Info)):    Info,
 	strings.ToLower(fmt.Sprint(Warning)): Warning,
 	strings.ToLower(fmt.Sprint(Error)):   Error,
+	strings.ToLower(fmt.Sprint(Fatal)):   Fatal,
+}
+
+/*
+logLevelsLock protects the log level maps.
+*/
+var logLevelsLock = sync.RWMutex{}
+
+/*
+StringToLoglevel tries to turn a given string into a log level. Returns an
+error if the string does not name a known log level.
+*/
+func StringToLoglevel(loglevelString string) (Level, error) {
+	logLevelsLock.RLock()
+	defer logLevelsLock.RUnlock()
+
+	level, ok := stringToLoglevel[strings.ToLower(loglevelString)]
+
+	if !ok {
+		return "", fmt.Errorf("Unknown log level: %v", loglevelString)
+	}
+
+	return level, nil
+}
+
+/*
+RegisterLogLevel registers a custom log level with a given priority. Messages
+of a level are handled by all sinks which have a level with the same or a lower
+priority. The priorities of the builtin levels are Trace: 10, Debug: 20,
+Info: 30, Warning: 40, Error: 50 and Fatal: 60.
+*/
+func RegisterLogLevel(name string, priority int) (Level, error) {
+	logLevelsLock.Lock()
+	defer logLevelsLock.Unlock()
+
+	if name == "" {
+		return "", fmt.Errorf("Log level name must not be empty")
+	}
+
+	if _, ok := stringToLoglevel[strings.ToLower(name)]; ok {
+		return "", fmt.Errorf("Log level %v already exists", name)
+	}
+
+	level := Level(name)
+
+	logLevelPriority[level] = priority
+	stringToLoglevel[strings.ToLower(name)] = level
+
+	return level, nil
 }
 
 /*
-StringToLoglevel tries to turn a given string into a log level.
+LogLevelPriority returns the priority of a given log level and if the log
+level is known.
 */
-func StringToLoglevel(loglevelString string) Level {
-	level, _ := stringToLoglevel[strings.ToLower(loglevelString)]
-	return level
+func LogLevelPriority(level Level) (int, bool) {
+	logLevelsLock.RLock()
+	defer logLevelsLock.RUnlock()
+
+	priority, ok := logLevelPriority[level]
+
+	return priority, ok
+}
+
+/*
+Field is a single structured key/value pair which is attached to a log message.
+*/
+type Field struct {
+	Key   string      // Key of the field
+	Value interface{} // Value of the field
 }
 
 /*
@@ -102,6 +180,16 @@ type Logger interface {
 	*/
 	AddLogSink(loglevel Level, formatter Formatter, appender io.Writer)
 
+	/*
+		Log logs a message at a given level.
+	*/
+	Log(loglevel Level, msg ...interface{})
+
+	/*
+		Trace logs a message at trace level.
+	*/
+	Trace(msg ...interface{})
+
 	/*
 		Debug logs a message at debug level.
 	*/
@@ -122,10 +210,57 @@ type Logger interface {
 	*/
 	Error(msg ...interface{})
 
+	/*
+		Fatal logs a message at fatal level. This does not terminate the program.
+	*/
+	Fatal(msg ...interface{})
+
 	/*
 		Error logs a message at error level and a stacktrace.
 	*/
 	LogStackTrace(loglevel Level, msg ...interface{})
+
+	/*
+		With returns a child logger of the same scope which attaches the given
+		key/value pairs to every log message.
+	*/
+	With(keysAndValues ...interface{}) Logger
+
+	/*
+		Logw logs a message with additional key/value pairs at a given level.
+	*/
+	Logw(loglevel Level, msg string, keysAndValues ...interface{})
+
+	/*
+		Tracew logs a message with additional key/value pairs at trace level.
+	*/
+	Tracew(msg string, keysAndValues ...interface{})
+
+	/*
+		Debugw logs a message with additional key/value pairs at debug level.
+	*/
+	Debugw(msg string, keysAndValues ...interface{})
+
+	/*
+		Infow logs a message with additional key/value pairs at info level.
+	*/
+	Infow(msg string, keysAndValues ...interface{})
+
+	/*
+		Warningw logs a message with additional key/value pairs at warning level.
+	*/
+	Warningw(msg string, keysAndValues ...interface{})
+
+	/*
+		Errorw logs a message with additional key/value pairs at error level.
+	*/
+	Errorw(msg string, keysAndValues ...interface{})
+
+	/*
+		Fatalw logs a message with additional key/value pairs at fatal level.
+		This does not terminate the program.
+	*/
+	Fatalw(msg string, keysAndValues ...interface{})
 }
 
 /*
@@ -133,7 +268,7 @@ GetLogger returns a logger of a certain scope. Use the empty string '' for the
 root scope.
 */
 func GetLogger(scope string) Logger {
-	return &logger{scope}
+	return &logger{scope, nil}
 }
 
 /*
@@ -143,6 +278,12 @@ func ClearLogSinks() {
 	logSinksLock.Lock()
 	defer logSinksLock.Unlock()
 
+	for _, sinks := range logSinks {
+		for _, sink := range sinks {
+			sink.close()
+		}
+	}
+
 	logSinks = make([][]*logSink, 0)
 }
 
@@ -150,7 +291,8 @@ func ClearLogSinks() {
 logger is the  main Logger interface implementation.
 */
 type logger struct {
-	scope string
+	scope  string  // Scope of the logger
+	fields []Field // Fields which are attached to every log message
 }
 
 /*
@@ -161,32 +303,53 @@ func (l *logger) AddLogSink(loglevel Level, formatter Formatter, appender io.Wri
 	addLogSink(loglevel, l.scope, formatter, appender)
 }
 
+/*
+Log logs a message at a given level.
+*/
+func (l *logger) Log(loglevel Level, msg ...interface{}) {
+	publishLog(loglevel, l.scope, l.fields, msg...)
+}
+
+/*
+Trace logs a message at trace level.
+*/
+func (l *logger) Trace(msg ...interface{}) {
+	publishLog(Trace, l.scope, l.fields, msg...)
+}
+
 /*
 Debug logs a message at debug level.
 */
 func (l *logger) Debug(msg ...interface{}) {
-	publishLog(Debug, l.scope, msg...)
+	publishLog(Debug, l.scope, l.fields, msg...)
 }
 
 /*
 Info logs a message at info level.
 */
 func (l *logger) Info(msg ...interface{}) {
-	publishLog(Info, l.scope, msg...)
+	publishLog(Info, l.scope, l.fields, msg...)
 }
 
 /*
 Warning logs a message at warning level.
 */
 func (l *logger) Warning(msg ...interface{}) {
-	publishLog(Warning, l.scope, msg...)
+	publishLog(Warning, l.scope, l.fields, msg...)
 }
 
 /*
 Error logs a message at error level.
 */
 func (l *logger) Error(msg ...interface{}) {
-	publishLog(Error, l.scope, msg...)
+	publishLog(Error, l.scope, l.fields, msg...)
+}
+
+/*
+Fatal logs a message at fatal level. This does not terminate the program.
+*/
+func (l *logger) Fatal(msg ...interface{}) {
+	publishLog(Fatal, l.scope, l.fields, msg...)
 }
 
 /*
@@ -195,7 +358,98 @@ Error logs a message at error level and a stacktrace.
 func (l *logger) LogStackTrace(loglevel Level, msg ...interface{}) {
 	msg = append(msg, fmt.Sprintln())
 	msg = append(msg, string(debug.Stack()))
-	publishLog(loglevel, l.scope, msg...)
+	publishLog(loglevel, l.scope, l.fields, msg...)
+}
+
+/*
+With returns a child logger of the same scope which attaches the given
+key/value pairs to every log message.
+*/
+func (l *logger) With(keysAndValues ...interface{}) Logger {
+	return &logger{l.scope, l.withFields(keysAndValues)}
+}
+
+/*
+Logw logs a message with additional key/value pairs at a given level.
+*/
+func (l *logger) Logw(loglevel Level, msg string, keysAndValues ...interface{}) {
+	publishLog(loglevel, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Tracew logs a message with additional key/value pairs at trace level.
+*/
+func (l *logger) Tracew(msg string, keysAndValues ...interface{}) {
+	publishLog(Trace, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Debugw logs a message with additional key/value pairs at debug level.
+*/
+func (l *logger) Debugw(msg string, keysAndValues ...interface{}) {
+	publishLog(Debug, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Infow logs a message with additional key/value pairs at info level.
+*/
+func (l *logger) Infow(msg string, keysAndValues ...interface{}) {
+	publishLog(Info, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Warningw logs a message with additional key/value pairs at warning level.
+*/
+func (l *logger) Warningw(msg string, keysAndValues ...interface{}) {
+	publishLog(Warning, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Errorw logs a message with additional key/value pairs at error level.
+*/
+func (l *logger) Errorw(msg string, keysAndValues ...interface{}) {
+	publishLog(Error, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+Fatalw logs a message with additional key/value pairs at fatal level.
+This does not terminate the program.
+*/
+func (l *logger) Fatalw(msg string, keysAndValues ...interface{}) {
+	publishLog(Fatal, l.scope, l.withFields(keysAndValues), msg)
+}
+
+/*
+withFields returns the fields of this logger extended by the given key/value
+pairs. Values of type Field are added as they are. A key without a value gets
+a nil value.
+*/
+func (l *logger) withFields(keysAndValues []interface{}) []Field {
+	if len(keysAndValues) == 0 {
+		return l.fields
+	}
+
+	fields := make([]Field, len(l.fields), len(l.fields)+len(keysAndValues)/2+1)
+	copy(fields, l.fields)
+
+	for i := 0; i < len(keysAndValues); i++ {
+
+		if f, ok := keysAndValues[i].(Field); ok {
+			fields = append(fields, f)
+			continue
+		}
+
+		f := Field{Key: fmt.Sprint(keysAndValues[i])}
+
+		if i+1 < len(keysAndValues) {
+			i++
+			f.Value = keysAndValues[i]
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
 }
 
 // Singleton logger
@@ -206,9 +460,43 @@ logSink models a single log sink.
 */
 type logSink struct {
 	io.Writer
-	level     Level
-	scope     string
-	formatter Formatter
+	id        int         // Unique id of the sink
+	level     Level       // Minimum level of messages handled by the sink
+	scope     string      // Scope of the sink
+	formatter Formatter   // Formatter of the sink
+	revert    *time.Timer // Optional timer which reverts a temporary level change
+	baseLevel Level       // Level which is restored by the revert timer
+}
+
+/*
+write writes a formatted log message to the sink. Errors are reported to the
+fallback logger.
+*/
+func (ls *logSink) write(fmsg string) {
+	if _, err := ls.Write([]byte(fmsg)); err != nil {
+
+		// Something went wrong use the fallback logger
+
+		fallbackLogger(fmt.Sprintf(
+			"Cloud not publish log message: %v (message: %v)",
+			err, fmsg))
+	}
+}
+
+/*
+close stops all timers of the sink and writes any output which is held back
+by its formatter. This function assumes that the logSinksLock is held.
+*/
+func (ls *logSink) close() {
+	if ls.revert != nil {
+		ls.revert.Stop()
+	}
+
+	if hf, ok := ls.formatter.(holdingFormatter); ok {
+		if out := hf.flush(); out != "" {
+			ls.write(out)
+		}
+	}
 }
 
 /*
@@ -227,32 +515,58 @@ var logSinks = make([][]*logSink, 0)
 var logSinksLock = sync.RWMutex{}
 
 /*
-addLogSink adds a new logging sink.
+logSinkCounter is used to assign unique ids to log sinks.
 */
-func addLogSink(level Level, scope string, formatter Formatter, sink io.Writer) {
+var logSinkCounter = 0
+
+/*
+addLogSink adds a new logging sink and returns its id.
+*/
+func addLogSink(level Level, scope string, formatter Formatter, sink io.Writer) int {
 	logSinksLock.Lock()
 	defer logSinksLock.Unlock()
 
+	logSinkCounter++
+
+	newSink := &logSink{sink, logSinkCounter, level, scope, formatter, nil, level}
+
+	if hf, ok := formatter.(holdingFormatter); ok {
+		newSink.formatter = hf.attach(func(due func() string) {
+			logSinksLock.RLock()
+			defer logSinksLock.RUnlock()
+
+			if out := due(); out != "" {
+				newSink.write(out)
+			}
+		})
+	}
+
 	// First see if the new sink can be appended to an existing list
 
 	for i, scopeSinks := range logSinks {
 		if scopeSinks[0].scope == scope {
-			scopeSinks = append(scopeSinks, &logSink{sink, level, scope, formatter})
+			scopeSinks = append(scopeSinks, newSink)
 			logSinks[i] = scopeSinks
-			return
+			return newSink.id
 		}
 	}
 
 	// Insert the new sink in the appropriate place
 
-	logSinks = append(logSinks, []*logSink{{sink, level, scope, formatter}})
+	logSinks = append(logSinks, []*logSink{newSink})
 	sort.Sort(sinkSlice(logSinks))
+
+	return newSink.id
 }
 
 /*
 publishLog publishes a log message.
 */
-func publishLog(loglevel Level, scope string, msg ...interface{}) {
+func publishLog(loglevel Level, scope string, fields []Field, msg ...interface{}) {
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+
+	msgPriority, _ := LogLevelPriority(loglevel)
 
 	// Go through the sorted list of sinks
 
@@ -268,20 +582,20 @@ func publishLog(loglevel Level, scope string, msg ...interface{}) {
 
 				// Check if the level is ok
 
-				if logLevelPriority[sink.level] <= logLevelPriority[loglevel] {
+				if sinkPriority, _ := LogLevelPriority(sink.level); sinkPriority <= msgPriority {
 
 					handled = true
 
-					fmsg := sink.formatter.Format(loglevel, scope, msg...)
+					fmsg := formatLog(sink.formatter, loglevel, scope, fields, msg...)
 
-					if _, err := sink.Write([]byte(fmsg)); err != nil {
+					if fmsg == "" {
 
-						// Something went wrong use the fallback logger
+						// The message was suppressed by the formatter
 
-						fallbackLogger(fmt.Sprintf(
-							"Cloud not publish log message: %v (message: %v)",
-							err, fmsg))
+						continue
 					}
+
+					sink.write(fmsg)
 				}
 			}
 
@@ -293,7 +607,25 @@ func publishLog(loglevel Level, scope string, msg ...interface{}) {
 
 	// No handler for log message use the fallback logger
 
-	fmsg := SimpleFormatter().Format(loglevel, scope, msg...)
+	fmsg := formatLog(SimpleFormatter(), loglevel, scope, fields, msg...)
 
 	fallbackLogger(fmt.Sprintf("No log handler for log message: %v", fmsg))
 }
+
+/*
+formatLog formats a log message with a given formatter. Fields are given to
+formatters which support them - for all other formatters the fields are
+appended to the message.
+*/
+func formatLog(formatter Formatter, loglevel Level, scope string, fields []Field, msg ...interface{}) string {
+
+	if sf, ok := formatter.(StructuredFormatter); ok {
+		return sf.FormatFields(loglevel, scope, fields, msg...)
+	}
+
+	if len(fields) > 0 {
+		msg = append(msg, " "+fieldsToString(fields))
+	}
+
+	return formatter.Format(loglevel, scope, msg...)
+}
@@ -25,8 +25,13 @@ func (bs *brokenSink) Write(p []byte) (n int, err error) {
 
 func TestLogging(t *testing.T) {
 
-	if StringToLoglevel("iNfO") != Info {
-		t.Error("Unexpected result")
+	if l, err := StringToLoglevel("iNfO"); l != Info || err != nil {
+		t.Error("Unexpected result:", l, err)
+		return
+	}
+
+	if l, err := StringToLoglevel("foo"); l != "" || err == nil || err.Error() != "Unknown log level: foo" {
+		t.Error("Unexpected result:", l, err)
 		return
 	}
 
@@ -177,3 +182,152 @@ func TestLogging(t *testing.T) {
 		return
 	}
 }
+
+func TestStructuredLogging(t *testing.T) {
+	ClearLogSinks()
+
+	sf := SimpleFormatter()
+
+	sf.(*simpleFormatter).tsFunc = func() string {
+		return "0000000000000" // Timestamp for testing is always 0
+	}
+
+	buf := &bytes.Buffer{}
+	logger := GetLogger("foo")
+
+	logger.AddLogSink(Debug, sf, buf)
+
+	logger.Infow("request served", "user", "bar", "duration", 5)
+
+	child := logger.With("requestid", 123)
+	child.Warningw("slow request", Field{"path", "/a b"})
+	child.Error("plain message")
+
+	// A key without value and a nested child logger
+
+	child.With("session", "").Debugw("dangling", "foo")
+
+	if buf.String() != `
+0000000000000 Info foo request served user=bar duration=5
+0000000000000 Warning foo slow request requestid=123 path="/a b"
+0000000000000 Error foo plain message requestid=123
+0000000000000 Debug foo dangling requestid=123 session="" foo=<nil>
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// The parent logger is not affected by its children
+
+	buf.Reset()
+
+	logger.Info("parent")
+
+	if buf.String() != "0000000000000 Info foo parent\n" {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	// Formatters which do not support fields get them appended to the message
+
+	ClearLogSinks()
+
+	buf.Reset()
+
+	logger.AddLogSink(Debug, &plainFormatter{}, buf)
+
+	child.Infow("test", "a", 1)
+
+	if buf.String() != "Info:test requestid=123 a=1" {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+}
+
+type plainFormatter struct {
+}
+
+func (pf *plainFormatter) Format(level Level, scope string, msg ...interface{}) string {
+	return fmt.Sprint(level, ":", fmt.Sprint(msg...))
+}
+
+func TestLogLevels(t *testing.T) {
+	ClearLogSinks()
+
+	defer func() {
+		logLevelsLock.Lock()
+		delete(logLevelPriority, "Notice")
+		delete(stringToLoglevel, "notice")
+		logLevelsLock.Unlock()
+	}()
+
+	notice, err := RegisterLogLevel("Notice", 35)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if l, err := StringToLoglevel("NOTICE"); l != notice || err != nil {
+		t.Error("Unexpected result:", l, err)
+		return
+	}
+
+	if p, ok := LogLevelPriority(notice); p != 35 || !ok {
+		t.Error("Unexpected result:", p, ok)
+		return
+	}
+
+	if p, ok := LogLevelPriority("foo"); p != 0 || ok {
+		t.Error("Unexpected result:", p, ok)
+		return
+	}
+
+	if _, err := RegisterLogLevel("notice", 1); err == nil || err.Error() != "Log level notice already exists" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if _, err := RegisterLogLevel("", 1); err == nil || err.Error() != "Log level name must not be empty" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	traceBuf := &bytes.Buffer{}
+	noticeBuf := &bytes.Buffer{}
+
+	GetLogger("").AddLogSink(Trace, ConsoleFormatter(), traceBuf)
+	GetLogger("foo").AddLogSink(notice, ConsoleFormatter(), noticeBuf)
+
+	logger := GetLogger("foo")
+
+	logger.Trace("test1")
+	logger.Info("test2")
+	logger.Log(notice, "test3")
+	logger.Warning("test4")
+	logger.Fatal("test5")
+	logger.Tracew("test6", "a", 1)
+	logger.Logw(notice, "test7", "a", 1)
+	logger.Fatalw("test8", "a", 1)
+
+	if traceBuf.String() != `
+Trace: test1
+Info: test2
+Trace: test6 a=1
+`[1:] {
+		t.Error("Unexpected output:", traceBuf.String())
+		return
+	}
+
+	if noticeBuf.String() != `
+Notice: test3
+Warning: test4
+Fatal: test5
+Notice: test7 a=1
+Fatal: test8 a=1
+`[1:] {
+		t.Error("Unexpected output:", noticeBuf.String())
+		return
+	}
+
+	ClearLogSinks()
+}
@@ -0,0 +1,162 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+LogSinkInfo describes a configured log sink.
+*/
+type LogSinkInfo struct {
+	ID        int    `json:"id"`        // Unique id of the sink
+	Scope     string `json:"scope"`     // Scope of the sink
+	Level     Level  `json:"level"`     // Minimum level of messages handled by the sink
+	Formatter string `json:"formatter"` // Type of the formatter of the sink
+	Appender  string `json:"appender"`  // Type of the appender of the sink
+}
+
+/*
+LogSinks returns a list of all configured log sinks. The most specific scopes
+are listed first.
+*/
+func LogSinks() []LogSinkInfo {
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+
+	ret := make([]LogSinkInfo, 0)
+
+	for _, sinks := range logSinks {
+		for _, sink := range sinks {
+			ret = append(ret, LogSinkInfo{
+				ID:        sink.id,
+				Scope:     sink.scope,
+				Level:     sink.level,
+				Formatter: fmt.Sprintf("%T", sink.formatter),
+				Appender:  fmt.Sprintf("%T", sink.Writer),
+			})
+		}
+	}
+
+	return ret
+}
+
+/*
+SetLogSinkLevel changes the level of a configured log sink.
+*/
+func SetLogSinkLevel(id int, level Level) error {
+	return SetLogSinkLevelFor(id, level, 0)
+}
+
+/*
+SetLogSinkLevelFor changes the level of a configured log sink for a given
+duration. The previous level is restored once the duration has passed. A
+duration of 0 makes the change permanent. A temporary change which replaces
+a pending one restores the level from before the pending change.
+*/
+func SetLogSinkLevelFor(id int, level Level, d time.Duration) error {
+	if _, ok := LogLevelPriority(level); !ok {
+		return fmt.Errorf("Unknown log level: %v", level)
+	}
+
+	logSinksLock.Lock()
+	defer logSinksLock.Unlock()
+
+	sink := findLogSink(id)
+
+	if sink == nil {
+		return fmt.Errorf("Unknown log sink: %v", id)
+	}
+
+	// Cancel any pending revert - a new change always replaces an old one
+
+	if sink.revert != nil {
+		sink.revert.Stop()
+		sink.revert = nil
+
+	} else {
+
+		sink.baseLevel = sink.level
+	}
+
+	if d > 0 {
+		var revert *time.Timer
+
+		revert = time.AfterFunc(d, func() {
+			logSinksLock.Lock()
+			defer logSinksLock.Unlock()
+
+			// Do nothing if the change was replaced while waiting for the lock
+
+			if s := findLogSink(id); s != nil && s.revert == revert {
+				s.level = s.baseLevel
+				s.revert = nil
+			}
+		})
+
+		sink.revert = revert
+	}
+
+	sink.level = level
+
+	return nil
+}
+
+/*
+RemoveLogSink removes a single configured log sink.
+*/
+func RemoveLogSink(id int) error {
+	logSinksLock.Lock()
+	defer logSinksLock.Unlock()
+
+	for i, sinks := range logSinks {
+		for j, sink := range sinks {
+
+			if sink.id != id {
+				continue
+			}
+
+			sink.close()
+
+			if len(sinks) == 1 {
+
+				// Remove the whole scope if this was its last sink
+
+				logSinks = append(logSinks[:i], logSinks[i+1:]...)
+
+			} else {
+
+				logSinks[i] = append(sinks[:j:j], sinks[j+1:]...)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unknown log sink: %v", id)
+}
+
+/*
+findLogSink finds a log sink by its id. This function assumes that the
+logSinksLock is held.
+*/
+func findLogSink(id int) *logSink {
+	for _, sinks := range logSinks {
+		for _, sink := range sinks {
+			if sink.id == id {
+				return sink
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLogSinkRegistry(t *testing.T) {
+	ClearLogSinks()
+
+	rootBuf := &bytes.Buffer{}
+	subBuf := &bytes.Buffer{}
+
+	GetLogger("").AddLogSink(Debug, ConsoleFormatter(), rootBuf)
+	GetLogger("foo.bar").AddLogSink(Info, ConsoleFormatter(), subBuf)
+	GetLogger("foo.bar").AddLogSink(Error, ConsoleFormatter(), subBuf)
+
+	sinks := LogSinks()
+
+	rootID := sinks[2].ID
+
+	if res := fmt.Sprint(sinks); res != fmt.Sprintf("[{%v foo.bar Info *logutil.consoleFormatter *bytes.Buffer} "+
+		"{%v foo.bar Error *logutil.consoleFormatter *bytes.Buffer} "+
+		"{%v  Debug *logutil.consoleFormatter *bytes.Buffer}]", rootID+1, rootID+2, rootID) {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	logger := GetLogger("foo.bar")
+
+	logger.Debug("test1")
+
+	if rootBuf.String() != "Debug: test1\n" || subBuf.String() != "" {
+		t.Error("Unexpected output:", rootBuf.String(), subBuf.String())
+		return
+	}
+
+	// Raise the level of the first sub sink
+
+	if err := SetLogSinkLevel(sinks[0].ID, Debug); err != nil {
+		t.Error(err)
+		return
+	}
+
+	logger.Debug("test2")
+
+	if rootBuf.String() != "Debug: test1\n" || subBuf.String() != "Debug: test2\n" {
+		t.Error("Unexpected output:", rootBuf.String(), subBuf.String())
+		return
+	}
+
+	// Remove the first sub sink
+
+	if err := RemoveLogSink(sinks[0].ID); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 2 || res[0].Level != Error {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	logger.Info("test3")
+
+	if rootBuf.String() != "Debug: test1\nInfo: test3\n" || subBuf.String() != "Debug: test2\n" {
+		t.Error("Unexpected output:", rootBuf.String(), subBuf.String())
+		return
+	}
+
+	// Remove the last sub sink which removes the scope
+
+	if err := RemoveLogSink(sinks[1].ID); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); len(res) != 1 || res[0].Scope != "" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Temporary level change
+
+	if err := SetLogSinkLevelFor(rootID, Error, 10*time.Millisecond); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if res := LogSinks(); res[0].Level != Error {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if res := LogSinks(); res[0].Level != Debug {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A permanent change cancels a pending revert
+
+	SetLogSinkLevelFor(rootID, Error, 10*time.Millisecond)
+	SetLogSinkLevel(rootID, Warning)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if res := LogSinks(); res[0].Level != Warning {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// A second temporary change still restores the original level
+
+	SetLogSinkLevelFor(rootID, Debug, 10*time.Millisecond)
+	SetLogSinkLevelFor(rootID, Error, 20*time.Millisecond)
+
+	if res := LogSinks(); res[0].Level != Error {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if res := LogSinks(); res[0].Level != Warning {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	// Test error cases
+
+	if err := SetLogSinkLevel(rootID, "foo"); err == nil || err.Error() != "Unknown log level: foo" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := SetLogSinkLevel(999, Debug); err == nil || err.Error() != "Unknown log sink: 999" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	if err := RemoveLogSink(999); err == nil || err.Error() != "Unknown log sink: 999" {
+		t.Error("Unexpected result:", err)
+		return
+	}
+
+	ClearLogSinks()
+
+	if res := LogSinks(); len(res) != 0 {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+/*
+SlogScopeKey is the attribute key which holds the scope of log messages
+which are forwarded to a slog.Handler.
+*/
+const SlogScopeKey = "scope"
+
+/*
+NewSlogHandler returns a slog.Handler which publishes all records through
+the log sinks of a given scope. Groups are mapped onto sub scopes, e.g. a
+group bar of a handler for scope foo publishes to the scope foo.bar. Record
+attributes become key/value fields of the log message.
+*/
+func NewSlogHandler(scope string) slog.Handler {
+	return &slogHandler{scope, nil}
+}
+
+/*
+slogHandler is the slog.Handler implementation.
+*/
+type slogHandler struct {
+	scope  string  // Scope of the handler
+	fields []Field // Fields from attributes which were added to the handler
+}
+
+/*
+Enabled reports whether a sink would handle a record of a given level.
+*/
+func (sh *slogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	msgPriority, _ := LogLevelPriority(SlogToLoglevel(level))
+
+	logSinksLock.RLock()
+	defer logSinksLock.RUnlock()
+
+	for _, sinks := range logSinks {
+		if strings.HasPrefix(sh.scope, sinks[0].scope) {
+			for _, sink := range sinks {
+				if sinkPriority, _ := LogLevelPriority(sink.level); sinkPriority <= msgPriority {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+Handle publishes a record. Log fields which are stored in the given context
+are added to the log message.
+*/
+func (sh *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	ctxFields := FieldsFromContext(ctx)
+
+	fields := make([]Field, 0, len(ctxFields)+len(sh.fields)+r.NumAttrs())
+	fields = append(fields, ctxFields...)
+	fields = append(fields, sh.fields...)
+
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendAttr(fields, "", a)
+		return true
+	})
+
+	publishLog(SlogToLoglevel(r.Level), sh.scope, fields, r.Message)
+
+	return nil
+}
+
+/*
+WithAttrs returns a new handler whose log messages include the given attributes.
+*/
+func (sh *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]Field, len(sh.fields), len(sh.fields)+len(attrs))
+	copy(fields, sh.fields)
+
+	for _, a := range attrs {
+		fields = appendAttr(fields, "", a)
+	}
+
+	return &slogHandler{sh.scope, fields}
+}
+
+/*
+WithGroup returns a new handler which publishes to a sub scope.
+*/
+func (sh *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return sh
+	}
+
+	scope := name
+
+	if sh.scope != "" {
+		scope = sh.scope + "." + name
+	}
+
+	return &slogHandler{scope, sh.fields}
+}
+
+/*
+appendAttr appends a slog attribute to a list of fields. Group attributes are
+flattened with dotted keys.
+*/
+func appendAttr(fields []Field, prefix string, a slog.Attr) []Field {
+	a.Value = a.Value.Resolve()
+
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+
+		for _, ga := range a.Value.Group() {
+			fields = appendAttr(fields, prefix, ga)
+		}
+
+		return fields
+	}
+
+	return append(fields, Field{prefix + a.Key, a.Value.Any()})
+}
+
+/*
+SlogToLoglevel maps a slog level onto a log level.
+*/
+func SlogToLoglevel(level slog.Level) Level {
+	switch {
+	case level < slog.LevelDebug:
+		return Trace
+	case level < slog.LevelInfo:
+		return Debug
+	case level < slog.LevelWarn:
+		return Info
+	case level < slog.LevelError:
+		return Warning
+	case level < slog.LevelError+4:
+		return Error
+	}
+
+	return Fatal
+}
+
+/*
+LoglevelToSlog maps a log level onto a slog level. The builtin levels
+are mapped as Trace: -8, Debug: -4, Info: 0, Warning: 4, Error: 8 and
+Fatal: 12. Custom levels are mapped according to their priority.
+*/
+func LoglevelToSlog(level Level) slog.Level {
+	priority, _ := LogLevelPriority(level)
+	return slog.Level((priority - 30) * 4 / 10)
+}
+
+/*
+SlogSink is a log sink which forwards all log messages to a slog.Handler.
+The SlogSink should be used as formatter and appender of the sink:
+
+	sink := NewSlogSink(handler)
+
+	logger.AddLogSink(Info, sink, sink)
+
+The scope of log messages is stored in the SlogScopeKey attribute. Make sure
+that the given slog.Handler does not publish back into logutil.
+*/
+type SlogSink struct {
+	handler slog.Handler // Handler which receives the log messages
+}
+
+/*
+NewSlogSink creates a new log sink which forwards to a given slog.Handler.
+*/
+func NewSlogSink(handler slog.Handler) *SlogSink {
+	return &SlogSink{handler}
+}
+
+/*
+Format forwards a given log message to the slog.Handler. Returns an empty
+string so nothing is written to the appender.
+*/
+func (ss *SlogSink) Format(level Level, scope string, msg ...interface{}) string {
+	return ss.FormatFields(level, scope, nil, msg...)
+}
+
+/*
+FormatFields forwards a given log message with its key/value fields to the
+slog.Handler. Returns an empty string so nothing is written to the appender.
+*/
+func (ss *SlogSink) FormatFields(level Level, scope string, fields []Field, msg ...interface{}) string {
+	ctx := context.Background()
+	slevel := LoglevelToSlog(level)
+
+	if ss.handler.Enabled(ctx, slevel) {
+		r := slog.NewRecord(time.Now(), slevel, fmt.Sprint(msg...), 0)
+
+		r.AddAttrs(slog.String(SlogScopeKey, scope))
+
+		for _, f := range fields {
+			r.AddAttrs(slog.Any(f.Key, f.Value))
+		}
+
+		if err := ss.handler.Handle(ctx, r); err != nil {
+			fallbackLogger(fmt.Sprintf("Could not publish log message: %v (message: %v)",
+				err, r.Message))
+		}
+	}
+
+	return ""
+}
+
+/*
+Write discards the given data. All log messages were already forwarded by the
+formatter.
+*/
+func (ss *SlogSink) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Public Domain Software
+ *
+ * I (Matthias Ladkau) am the author of the source code in this file.
+ * I have placed the source code in this file in the public domain.
+ *
+ * For further information see: http://creativecommons.org/publicdomain/zero/1.0/
+ */
+
+package logutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogHandler(t *testing.T) {
+	ClearLogSinks()
+
+	sf := SimpleFormatter()
+
+	sf.(*simpleFormatter).tsFunc = func() string {
+		return "0000000000000" // Timestamp for testing is always 0
+	}
+
+	rootBuf := &bytes.Buffer{}
+	subBuf := &bytes.Buffer{}
+
+	GetLogger("").AddLogSink(Warning, sf, rootBuf)
+	GetLogger("foo.bar").AddLogSink(Debug, sf, subBuf)
+
+	sl := slog.New(NewSlogHandler("foo"))
+
+	sl.Debug("test1")
+	sl.Warn("test2", "a", 1, slog.Group("g", "b", "x y"))
+	sl.With("id", 5).WithGroup("bar").Debug("test3", "c", true)
+	sl.Log(context.Background(), slog.LevelDebug-4, "test4")
+	sl.Log(context.Background(), slog.LevelError+4, "test5")
+
+	if rootBuf.String() != `
+0000000000000 Warning foo test2 a=1 g.b="x y"
+0000000000000 Fatal foo test5
+`[1:] {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+
+	if subBuf.String() != `
+0000000000000 Debug foo.bar test3 id=5 c=true
+`[1:] {
+		t.Error("Unexpected output:", subBuf.String())
+		return
+	}
+
+	h := NewSlogHandler("foo")
+
+	if h.Enabled(context.Background(), slog.LevelInfo) || !h.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("Unexpected enabled state")
+		return
+	}
+
+	if h.WithGroup("") != h || !h.WithGroup("bar").Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("Unexpected group handling")
+		return
+	}
+
+	if res := NewSlogHandler("").WithGroup("foo").(*slogHandler).scope; res != "foo" {
+		t.Error("Unexpected scope:", res)
+		return
+	}
+
+	// The caller is the slog call site
+
+	ClearLogSinks()
+
+	rootBuf.Reset()
+
+	GetLogger("").AddLogSink(Debug, TemplateFormatter("%c %m"), rootBuf)
+
+	sl.Info("test6")
+
+	if !strings.Contains(rootBuf.String(), "slog_test.go:") {
+		t.Error("Unexpected output:", rootBuf.String())
+		return
+	}
+
+	ClearLogSinks()
+}
+
+func TestSlogSink(t *testing.T) {
+	ClearLogSinks()
+
+	buf := &bytes.Buffer{}
+
+	sh := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+
+	sink := NewSlogSink(sh)
+
+	GetLogger("foo").AddLogSink(Trace, sink, sink)
+
+	logger := GetLogger("foo.bar")
+
+	logger.Trace("test1")
+	logger.Debug("test2")
+	logger.With("id", 5).Infow("test3", "a", "x y")
+	logger.Fatal("test4")
+
+	if buf.String() != `
+level=DEBUG msg=test2 scope=foo.bar
+level=INFO msg=test3 scope=foo.bar id=5 a="x y"
+level=ERROR+4 msg=test4 scope=foo.bar
+`[1:] {
+		t.Error("Unexpected output:", buf.String())
+		return
+	}
+
+	if res := fmt.Sprint(LoglevelToSlog(Trace), LoglevelToSlog(Warning), LoglevelToSlog("foo")); res != "DEBUG-4 WARN DEBUG-8" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+
+	if n, err := sink.Write([]byte("test")); n != 4 || err != nil {
+		t.Error("Unexpected result:", n, err)
+		return
+	}
+
+	ClearLogSinks()
+}
@@ -28,18 +28,51 @@ will return 0 and pop will return nil. If the function returns a negative value
 then the value is ignored.
 */
 type PriorityQueue struct {
-	heap         *priorityQueueHeap // Heap which holds the values
-	orderCounter int
-	MinPriority  func() int // Function returning the minimum priority
+	*TypedPriorityQueue[interface{}]
 }
 
 /*
 NewPriorityQueue creates a new priority queue.
 */
 func NewPriorityQueue() *PriorityQueue {
+	return &PriorityQueue{NewTypedPriorityQueue[interface{}]()}
+}
+
+/*
+Peek returns the next item of the queue but does not remove it. Returns nil
+if there is no item.
+*/
+func (pq *PriorityQueue) Peek() interface{} {
+	v, _ := pq.TypedPriorityQueue.Peek()
+	return v
+}
+
+/*
+Pop remove the next element from the queue and returns it. Returns nil if
+there is no item.
+*/
+func (pq *PriorityQueue) Pop() interface{} {
+	v, _ := pq.TypedPriorityQueue.Pop()
+	return v
+}
 
-	pqheap := make(priorityQueueHeap, 0)
-	pq := &PriorityQueue{&pqheap, 0, func() int { return -1 }}
+/*
+TypedPriorityQueue is a priority queue which holds values of a given type.
+It has the same semantics as PriorityQueue.
+*/
+type TypedPriorityQueue[T any] struct {
+	heap         *priorityQueueHeap[T] // Heap which holds the values
+	orderCounter int
+	MinPriority  func() int // Function returning the minimum priority
+}
+
+/*
+NewTypedPriorityQueue creates a new typed priority queue.
+*/
+func NewTypedPriorityQueue[T any]() *TypedPriorityQueue[T] {
+
+	pqheap := make(priorityQueueHeap[T], 0)
+	pq := &TypedPriorityQueue[T]{&pqheap, 0, func() int { return -1 }}
 
 	heap.Init(pq.heap)
 
@@ -49,8 +82,8 @@ func NewPriorityQueue() *PriorityQueue {
 /*
 Clear clears the current queue contents.
 */
-func (pq *PriorityQueue) Clear() {
-	pqheap := make(priorityQueueHeap, 0)
+func (pq *TypedPriorityQueue[T]) Clear() {
+	pqheap := make(priorityQueueHeap[T], 0)
 	pq.heap = &pqheap
 	pq.orderCounter = 0
 	heap.Init(pq.heap)
@@ -59,18 +92,18 @@ func (pq *PriorityQueue) Clear() {
 /*
 CurrentPriority returns the priority of the next item.
 */
-func (pq *PriorityQueue) CurrentPriority() int {
+func (pq *TypedPriorityQueue[T]) CurrentPriority() int {
 	if len(*pq.heap) == 0 {
 		return 0
 	}
 
-	return pq.heap.Peek().(*pqItem).priority
+	return pq.heap.Peek().priority
 }
 
 /*
 Push adds a new element to the queue.
 */
-func (pq *PriorityQueue) Push(value interface{}, priority int) {
+func (pq *TypedPriorityQueue[T]) Push(value T, priority int) {
 
 	// Highest priority is 0 we can't go higher
 
@@ -78,43 +111,49 @@ func (pq *PriorityQueue) Push(value interface{}, priority int) {
 		priority = 0
 	}
 
-	heap.Push(pq.heap, &pqItem{value, priority, pq.orderCounter, 0})
+	heap.Push(pq.heap, &pqItem[T]{value, priority, pq.orderCounter, 0})
 	pq.orderCounter++
 }
 
 /*
-Peek returns the next item of the queue but does not remove it.
+Peek returns the next item of the queue but does not remove it. The second
+return value is false if there is no item.
 */
-func (pq *PriorityQueue) Peek() interface{} {
+func (pq *TypedPriorityQueue[T]) Peek() (T, bool) {
+	var zero T
+
 	minPriority := pq.MinPriority()
 
-	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().(*pqItem).priority > minPriority) {
-		return nil
+	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().priority > minPriority) {
+		return zero, false
 	}
 
-	return pq.heap.Peek().(*pqItem).value
+	return pq.heap.Peek().value, true
 }
 
 /*
-Pop remove the next element from the queue and returns it.
+Pop remove the next element from the queue and returns it. The second return
+value is false if there is no item.
 */
-func (pq *PriorityQueue) Pop() interface{} {
+func (pq *TypedPriorityQueue[T]) Pop() (T, bool) {
+	var zero T
+
 	minPriority := pq.MinPriority()
 
-	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().(*pqItem).priority > minPriority) {
-		return nil
+	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().priority > minPriority) {
+		return zero, false
 	}
 
-	return heap.Pop(pq.heap).(*pqItem).value
+	return heap.Pop(pq.heap).(*pqItem[T]).value, true
 }
 
 /*
 Size returns the current queue size.
 */
-func (pq *PriorityQueue) Size() int {
+func (pq *TypedPriorityQueue[T]) Size() int {
 	minPriority := pq.MinPriority()
 
-	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().(*pqItem).priority > minPriority) {
+	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().priority > minPriority) {
 		return 0
 	}
 	return len(*pq.heap)
@@ -123,14 +162,14 @@ func (pq *PriorityQueue) Size() int {
 /*
 SizeCurrentPriority returns the queue size of all elements of the highest priority.
 */
-func (pq *PriorityQueue) SizeCurrentPriority() int {
+func (pq *TypedPriorityQueue[T]) SizeCurrentPriority() int {
 	minPriority := pq.MinPriority()
 
-	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().(*pqItem).priority > minPriority) {
+	if len(*pq.heap) == 0 || (minPriority > 0 && pq.heap.Peek().priority > minPriority) {
 		return 0
 	}
 
-	higestPriority := pq.heap.Peek().(*pqItem).priority
+	higestPriority := pq.heap.Peek().priority
 	counter := 0
 
 	for _, item := range *pq.heap {
@@ -145,7 +184,7 @@ func (pq *PriorityQueue) SizeCurrentPriority() int {
 /*
 String returns a string representation of the queue.
 */
-func (pq *PriorityQueue) String() string {
+func (pq *TypedPriorityQueue[T]) String() string {
 	var ret bytes.Buffer
 
 	ret.WriteString("[ ")
@@ -165,28 +204,28 @@ func (pq *PriorityQueue) String() string {
 /*
 pqItem models an item in the priority queue.
 */
-type pqItem struct {
-	value    interface{} // Value which is held in the queue
-	priority int         // Priority of the item
-	order    int         // Order of adding
-	index    int         // Item index in the heap (required by heap).
+type pqItem[T any] struct {
+	value    T   // Value which is held in the queue
+	priority int // Priority of the item
+	order    int // Order of adding
+	index    int // Item index in the heap (required by heap).
 }
 
 /*
 priorityQueueHeap implements the heap.Interface and is the datastructure which
 actually holds items.
 */
-type priorityQueueHeap []*pqItem
+type priorityQueueHeap[T any] []*pqItem[T]
 
-func (pq priorityQueueHeap) Len() int { return len(pq) }
-func (pq priorityQueueHeap) Less(i, j int) bool {
+func (pq priorityQueueHeap[T]) Len() int { return len(pq) }
+func (pq priorityQueueHeap[T]) Less(i, j int) bool {
 	if pq[i].priority != pq[j].priority {
 		return pq[i].priority < pq[j].priority
 	}
 
 	return pq[i].order < pq[j].order
 }
-func (pq priorityQueueHeap) Swap(i, j int) {
+func (pq priorityQueueHeap[T]) Swap(i, j int) {
 	pq[i], pq[j] = pq[j], pq[i]
 	pq[i].index = i
 	pq[j].index = j
@@ -195,9 +234,9 @@ func (pq priorityQueueHeap) Swap(i, j int) {
 /*
 Push adds an item to the queue.
 */
-func (pq *priorityQueueHeap) Push(x interface{}) {
+func (pq *priorityQueueHeap[T]) Push(x interface{}) {
 	n := len(*pq)
-	item := x.(*pqItem)
+	item := x.(*pqItem[T])
 
 	item.index = n
 
@@ -207,7 +246,7 @@ func (pq *priorityQueueHeap) Push(x interface{}) {
 /*
 Pop removes an item from the queue.
 */
-func (pq *priorityQueueHeap) Pop() interface{} {
+func (pq *priorityQueueHeap[T]) Pop() interface{} {
 	old := *pq
 	n := len(old)
 	item := old[n-1]
@@ -221,7 +260,7 @@ func (pq *priorityQueueHeap) Pop() interface{} {
 /*
 Peek returns the next item but does not remove it from the queue.
 */
-func (pq *priorityQueueHeap) Peek() interface{} {
+func (pq *priorityQueueHeap[T]) Peek() *pqItem[T] {
 	q := *pq
 	return q[0]
 }
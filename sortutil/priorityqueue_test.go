@@ -194,3 +194,44 @@ func TestPriorityQueue(t *testing.T) {
 	}
 
 }
+
+func TestTypedPriorityQueue(t *testing.T) {
+
+	pq := NewTypedPriorityQueue[int]()
+
+	if v, ok := pq.Pop(); ok || v != 0 {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	pq.Push(10, 1)
+	pq.Push(80, 8)
+	pq.Push(11, 1)
+
+	if v, ok := pq.Peek(); !ok || v != 10 || pq.SizeCurrentPriority() != 2 {
+		t.Error("Unexpected result:", v, ok)
+		return
+	}
+
+	pq.MinPriority = func() int {
+		return 5
+	}
+
+	sum := 0
+
+	for v, ok := pq.Pop(); ok; v, ok = pq.Pop() {
+		sum += v
+	}
+
+	if sum != 21 || pq.Size() != 0 || pq.CurrentPriority() != 8 {
+		t.Error("Unexpected result:", sum, pq)
+		return
+	}
+
+	pq.Clear()
+
+	if res := pq.String(); res != "[ ]" {
+		t.Error("Unexpected result:", res)
+		return
+	}
+}